@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tg123/go-htpasswd"
+)
+
+// htpasswdAuth validates clients against an htpasswd file, hot-reloading it
+// whenever its mtime changes. Tokens are expected in "username:password"
+// form. A matched username may carry a per-client quota, loaded from the
+// separate file named by the "quotas" query param (not the htpasswd file
+// itself, which has no room for it) and reloaded on the same schedule.
+type htpasswdAuth struct {
+	path       string
+	quotasPath string
+	reload     time.Duration
+
+	mu        sync.RWMutex
+	file      *htpasswd.File
+	modTime   time.Time
+	quotas    map[string]Quota
+	quotasMod time.Time
+
+	limiter *ipLimiter
+	stop    chan struct{}
+}
+
+func newHtpasswdAuth(u *url.URL) (Auth, error) {
+	reloadEvery, err := durationParam(u, "reload", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	h := &htpasswdAuth{
+		path:       u.Path,
+		quotasPath: u.Query().Get("quotas"),
+		reload:     reloadEvery,
+		quotas:     make(map[string]Quota),
+		limiter:    newIPLimiter(5, time.Minute),
+		stop:       make(chan struct{}),
+	}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	go h.watch()
+	return h, nil
+}
+
+func (h *htpasswdAuth) watch() {
+	ticker := time.NewTicker(h.reload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			changed := false
+			if fi, err := os.Stat(h.path); err == nil && fi.ModTime().After(h.modTime) {
+				changed = true
+			}
+			if h.quotasPath != "" {
+				if fi, err := os.Stat(h.quotasPath); err == nil && fi.ModTime().After(h.quotasMod) {
+					changed = true
+				}
+			}
+			if changed {
+				h.Reload()
+			}
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (h *htpasswdAuth) Reload() error {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	file, err := htpasswd.New(h.path, htpasswd.DefaultSystems, nil)
+	if err != nil {
+		return err
+	}
+
+	quotas := h.quotas
+	quotasMod := h.quotasMod
+	if h.quotasPath != "" {
+		qfi, err := os.Stat(h.quotasPath)
+		if err != nil {
+			return err
+		}
+		quotas, err = loadQuotas(h.quotasPath)
+		if err != nil {
+			return err
+		}
+		quotasMod = qfi.ModTime()
+	}
+
+	h.mu.Lock()
+	h.file = file
+	h.modTime = fi.ModTime()
+	h.quotas = quotas
+	h.quotasMod = quotasMod
+	h.mu.Unlock()
+	return nil
+}
+
+// loadQuotas parses a quotas file into per-username Quotas. Each non-empty,
+// non-comment line is "username maxTunnels [subdomain1,subdomain2,...]";
+// the subdomain list is optional and empty means no subdomain restriction.
+func loadQuotas(path string) (map[string]Quota, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	quotas := make(map[string]Quota)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		maxTunnels, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		q := Quota{MaxTunnels: maxTunnels}
+		if len(fields) > 2 {
+			q.AllowedSubdomain = strings.Split(fields[2], ",")
+		}
+		quotas[fields[0]] = q
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+func (h *htpasswdAuth) Stop() {
+	close(h.stop)
+}
+
+func (h *htpasswdAuth) Validate(token string, meta ClientMeta) (bool, error) {
+	if !h.limiter.Allow(meta.ClientIP) {
+		return false, nil
+	}
+	username, password, ok := splitToken(token)
+	if !ok {
+		h.limiter.Fail(meta.ClientIP)
+		return false, nil
+	}
+	h.mu.RLock()
+	file := h.file
+	h.mu.RUnlock()
+	if file == nil || !file.Match(username, password) {
+		h.limiter.Fail(meta.ClientIP)
+		return false, nil
+	}
+	return true, nil
+}
+
+// QuotaFor returns the quota configured for token's username (the same
+// "username:password" token already passed to Validate), or the zero Quota
+// (unlimited) if none was configured.
+func (h *htpasswdAuth) QuotaFor(token string) Quota {
+	username, _, ok := splitToken(token)
+	if !ok {
+		return Quota{}
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.quotas[username]
+}
+
+func splitToken(token string) (user, pass string, ok bool) {
+	idx := strings.IndexByte(token, ':')
+	if idx < 0 {
+		return "", "", false
+	}
+	return token[:idx], token[idx+1:], true
+}
+
+// ipLimiter rate-limits repeated failed attempts per source IP, so a single
+// client can't hammer the control listener with credential-stuffing
+// attempts once it has failed a handful of times within window.
+type ipLimiter struct {
+	maxFailures int
+	window      time.Duration
+
+	mu      sync.Mutex
+	history map[string][]time.Time
+}
+
+func newIPLimiter(maxFailures int, window time.Duration) *ipLimiter {
+	return &ipLimiter{maxFailures: maxFailures, window: window, history: make(map[string][]time.Time)}
+}
+
+func (l *ipLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	times := l.history[ip]
+	cutoff := time.Now().Add(-l.window)
+	kept := times[:0]
+	for _, t := range times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	l.history[ip] = kept
+	return len(kept) < l.maxFailures
+}
+
+func (l *ipLimiter) Fail(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.history[ip] = append(l.history[ip], time.Now())
+}
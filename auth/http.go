@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// httpAuth validates clients against a remote verification endpoint,
+// POSTing {token, client_ip} and caching affirmative responses for
+// cacheTTL so a flaky or slow auth service doesn't add latency to every
+// reconnect. Failed attempts are rate-limited per source IP the same way
+// htpasswdAuth's are, since a remote endpoint is no defense against a
+// client hammering the control listener itself with guesses.
+type httpAuth struct {
+	endpoint string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]time.Time
+
+	limiter *ipLimiter
+}
+
+type httpAuthRequest struct {
+	Token    string `json:"token"`
+	ClientIP string `json:"client_ip"`
+}
+
+type httpAuthResponse struct {
+	OK bool `json:"ok"`
+}
+
+func newHTTPAuth(u *url.URL) (Auth, error) {
+	timeout, err := durationParam(u, "timeout", time.Second*3)
+	if err != nil {
+		return nil, err
+	}
+	cacheTTL, err := durationParam(u, "cache", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := *u
+	q := endpoint.Query()
+	q.Del("timeout")
+	q.Del("cache")
+	endpoint.RawQuery = q.Encode()
+	return &httpAuth{
+		endpoint: endpoint.String(),
+		client:   &http.Client{Timeout: timeout},
+		cacheTTL: cacheTTL,
+		cache:    make(map[string]time.Time),
+		limiter:  newIPLimiter(5, time.Minute),
+	}, nil
+}
+
+func (h *httpAuth) Validate(token string, meta ClientMeta) (bool, error) {
+	if expiry, ok := h.cacheGet(token); ok && time.Now().Before(expiry) {
+		return true, nil
+	}
+	if !h.limiter.Allow(meta.ClientIP) {
+		return false, nil
+	}
+	body, err := json.Marshal(httpAuthRequest{Token: token, ClientIP: meta.ClientIP})
+	if err != nil {
+		return false, err
+	}
+	resp, err := h.client.Post(h.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		h.limiter.Fail(meta.ClientIP)
+		return false, nil
+	}
+	var res httpAuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false, err
+	}
+	if res.OK {
+		h.cacheSet(token)
+	} else {
+		h.limiter.Fail(meta.ClientIP)
+	}
+	return res.OK, nil
+}
+
+func (h *httpAuth) cacheGet(token string) (time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	expiry, ok := h.cache[token]
+	return expiry, ok
+}
+
+func (h *httpAuth) cacheSet(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cache[token] = time.Now().Add(h.cacheTTL)
+}
+
+func (h *httpAuth) Reload() error { return nil }
+
+func (h *httpAuth) Stop() {}
@@ -0,0 +1,25 @@
+package auth
+
+import "net/url"
+
+// staticAuth validates against a single fixed token, set with
+// "static://?token=...". It is the zero-configuration default and the
+// closest equivalent to the previous hard-coded contrib.Auth check.
+type staticAuth struct {
+	token string
+}
+
+func newStaticAuth(u *url.URL) (Auth, error) {
+	return &staticAuth{token: u.Query().Get("token")}, nil
+}
+
+func (s *staticAuth) Validate(token string, meta ClientMeta) (bool, error) {
+	if s.token == "" {
+		return true, nil
+	}
+	return token == s.token, nil
+}
+
+func (s *staticAuth) Reload() error { return nil }
+
+func (s *staticAuth) Stop() {}
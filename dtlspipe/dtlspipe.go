@@ -0,0 +1,66 @@
+// Package dtlspipe carries UDP tunnel payloads over a DTLS 1.2 association
+// instead of a smux stream, so datagram boundaries survive the trip between
+// client and server instead of being flattened into a byte stream.
+//
+// A single long-lived UDP socket (the "flock") is shared by every DTLS
+// association a Control owns; packets are demultiplexed by remote address
+// before being handed to the matching *dtls.Conn. The DTLS handshake still
+// runs, but in PSK mode: the PSK is derived from the control channel's
+// preMasterSecret via crypto.NewPrf12, so a peer has to have completed
+// Lunnel's own authenticated key exchange before it can bring up a DTLS
+// association. No certificate or fresh ECDHE exchange is performed.
+package dtlspipe
+
+import (
+	"net"
+
+	"Lunnel/crypto"
+
+	"github.com/pion/dtls/v2"
+)
+
+// derivePSK derives the DTLS pre-shared key for a client+tunnel pair from
+// the control channel's preMasterSecret, binding the DTLS association to
+// the already-authenticated control session the same way PipeHandShake
+// derives a smux pipe's crypto key.
+func derivePSK(preMasterSecret []byte, clientID, tunnelName []byte) []byte {
+	prf := crypto.NewPrf12()
+	psk := make([]byte, 16)
+	prf(psk, preMasterSecret, clientID, tunnelName)
+	return psk
+}
+
+// Config bundles the parameters needed to bring up either side of a DTLS
+// association over an already-demultiplexed net.Conn.
+type Config struct {
+	PreMasterSecret []byte
+	ClientID        []byte
+	TunnelName      string
+}
+
+// Server runs the DTLS server handshake on conn (typically a per-remote
+// *assocConn handed out by a Listener) using a PSK derived from cfg.
+func Server(conn net.Conn, cfg Config) (*dtls.Conn, error) {
+	psk := derivePSK(cfg.PreMasterSecret, cfg.ClientID, []byte(cfg.TunnelName))
+	dtlsConfig := &dtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			return psk, nil
+		},
+		PSKIdentityHint: cfg.ClientID,
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	}
+	return dtls.Server(conn, dtlsConfig)
+}
+
+// Client runs the DTLS client handshake, mirroring Server.
+func Client(conn net.Conn, cfg Config) (*dtls.Conn, error) {
+	psk := derivePSK(cfg.PreMasterSecret, cfg.ClientID, []byte(cfg.TunnelName))
+	dtlsConfig := &dtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			return psk, nil
+		},
+		PSKIdentityHint: cfg.ClientID,
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	}
+	return dtls.Client(conn, dtlsConfig)
+}
@@ -0,0 +1,162 @@
+package dtlspipe
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener demultiplexes a single shared net.PacketConn into one assocConn
+// per remote address, so every client's DTLS association can be driven
+// with the plain net.Conn interface pion/dtls expects while the underlying
+// UDP socket stays shared across every association the server holds (the
+// "flock" described in the request this package implements).
+type Listener struct {
+	pc net.PacketConn
+
+	mu    sync.Mutex
+	assoc map[string]*assocConn
+
+	accept chan *assocConn
+	closed chan struct{}
+}
+
+// NewListener starts demultiplexing pc. Each time a datagram arrives from a
+// remote address with no existing association, a new assocConn is created
+// and delivered to Accept.
+func NewListener(pc net.PacketConn) *Listener {
+	l := &Listener{
+		pc:     pc,
+		assoc:  make(map[string]*assocConn),
+		accept: make(chan *assocConn, 16),
+		closed: make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, remote, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		payload := make([]byte, n)
+		copy(payload, buf[:n])
+
+		l.mu.Lock()
+		a, ok := l.assoc[remote.String()]
+		if !ok {
+			a = newAssocConn(l.pc, remote, func() { l.forget(remote) })
+			l.assoc[remote.String()] = a
+			select {
+			case l.accept <- a:
+			case <-l.closed:
+				l.mu.Unlock()
+				return
+			}
+		}
+		l.mu.Unlock()
+		a.deliver(payload)
+	}
+}
+
+func (l *Listener) forget(remote net.Addr) {
+	l.mu.Lock()
+	delete(l.assoc, remote.String())
+	l.mu.Unlock()
+}
+
+// Accept returns the next newly observed remote association.
+func (l *Listener) Accept() (*assocConn, error) {
+	select {
+	case a := <-l.accept:
+		return a, nil
+	case <-l.closed:
+		return nil, errors.New("dtlspipe: listener closed")
+	}
+}
+
+// Close stops demultiplexing and closes the shared PacketConn. Existing
+// associations are not closed, but they can no longer send or receive
+// once the PacketConn they ride on is gone.
+func (l *Listener) Close() error {
+	close(l.closed)
+	return l.pc.Close()
+}
+
+// Dial returns (creating if necessary) the association used to talk to
+// remote, for the client side of the flock where the local process
+// initiates rather than accepts.
+func (l *Listener) Dial(remote net.Addr) *assocConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if a, ok := l.assoc[remote.String()]; ok {
+		return a
+	}
+	a := newAssocConn(l.pc, remote, func() { l.forget(remote) })
+	l.assoc[remote.String()] = a
+	return a
+}
+
+// assocConn adapts one remote address's slice of a shared net.PacketConn
+// into a net.Conn, which is the interface pion/dtls's Server/Client
+// constructors expect.
+type assocConn struct {
+	pc     net.PacketConn
+	remote net.Addr
+	in     chan []byte
+	onDone func()
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newAssocConn(pc net.PacketConn, remote net.Addr, onDone func()) *assocConn {
+	return &assocConn{
+		pc:     pc,
+		remote: remote,
+		in:     make(chan []byte, 64),
+		onDone: onDone,
+		closed: make(chan struct{}),
+	}
+}
+
+func (a *assocConn) deliver(payload []byte) {
+	select {
+	case a.in <- payload:
+	case <-a.closed:
+	}
+}
+
+func (a *assocConn) Read(p []byte) (int, error) {
+	select {
+	case payload := <-a.in:
+		return copy(p, payload), nil
+	case <-a.closed:
+		return 0, errors.New("dtlspipe: association closed")
+	}
+}
+
+func (a *assocConn) Write(p []byte) (int, error) {
+	return a.pc.WriteTo(p, a.remote)
+}
+
+func (a *assocConn) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.closed)
+		if a.onDone != nil {
+			a.onDone()
+		}
+	})
+	return nil
+}
+
+func (a *assocConn) LocalAddr() net.Addr  { return a.pc.LocalAddr() }
+func (a *assocConn) RemoteAddr() net.Addr { return a.remote }
+
+func (a *assocConn) SetDeadline(t time.Time) error      { return nil }
+func (a *assocConn) SetReadDeadline(t time.Time) error  { return nil }
+func (a *assocConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,461 @@
+package pipe
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/pkg/errors"
+)
+
+// H2MuxerConfig bounds the behaviour of an H2Muxer: window sizing comes
+// from serverConf, ping cadence from the same pingInterval/pingTimeout the
+// control channel itself uses, so RTT samples stay on a comparable clock.
+type H2MuxerConfig struct {
+	WindowSize   int32
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+}
+
+// H2Muxer multiplexes streams over a single pipe connection using an
+// HTTP/2 framer (golang.org/x/net/http2), instead of smux. Every stream
+// gets its own flow-control window, so one slow consumer stalls only its
+// own stream's DATA frames instead of blocking smux's single receive
+// buffer for the whole pipe.
+type H2Muxer struct {
+	conn   net.Conn
+	framer *http2.Framer
+
+	hpackBuf *bytes.Buffer
+	hpackEnc *hpack.Encoder
+
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	streams      map[uint32]*h2Stream
+	nextStreamID uint32
+	closed       bool
+	closeCh      chan struct{}
+
+	cfg H2MuxerConfig
+
+	// recvWindow accumulates bytes delivered to streams since the last
+	// connection-level WINDOW_UPDATE we sent; readLoop is its only writer,
+	// so it needs no lock. connSendWindow is the send-side counterpart
+	// (decremented by every stream's Write, replenished by the peer's
+	// connection-level WINDOW_UPDATE), so it's touched from many goroutines
+	// and needs atomic access like h2Stream.sendWindow does.
+	recvWindow       int32
+	connSendWindow   int32
+	connWindowSignal chan struct{}
+
+	rtt          int64 // nanoseconds, updated atomically from PING acks
+	pingInFlight sync.Map
+	pingAcked    chan struct{}
+}
+
+// NewH2Muxer performs a minimal HTTP/2 handshake (preface + a SETTINGS
+// exchange advertising cfg.WindowSize as the initial window) over conn and returns a Muxer driving streams on top of it. The
+// server always plays the stream-opening ("client") role in HTTP/2 terms,
+// matching how the existing smux path already uses smux.Client on the
+// server side: the server is what originates new streams toward the
+// tunnel client as external connections arrive.
+func NewH2Muxer(conn net.Conn, cfg H2MuxerConfig) (*H2Muxer, error) {
+	if cfg.WindowSize <= 0 {
+		cfg.WindowSize = 256 * 1024
+	}
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, errors.Wrap(err, "h2mux: write client preface")
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: uint32(cfg.WindowSize)}); err != nil {
+		return nil, errors.Wrap(err, "h2mux: write SETTINGS")
+	}
+	if err := awaitSettings(framer); err != nil {
+		return nil, errors.Wrap(err, "h2mux: await peer SETTINGS")
+	}
+
+	var hpackBuf bytes.Buffer
+	m := &H2Muxer{
+		conn:             conn,
+		framer:           framer,
+		hpackBuf:         &hpackBuf,
+		hpackEnc:         hpack.NewEncoder(&hpackBuf),
+		streams:          make(map[uint32]*h2Stream),
+		nextStreamID:     1,
+		closeCh:          make(chan struct{}),
+		pingAcked:        make(chan struct{}, 1),
+		cfg:              cfg,
+		connSendWindow:   cfg.WindowSize,
+		connWindowSignal: make(chan struct{}, 1),
+	}
+	go m.readLoop()
+	if cfg.PingInterval > 0 {
+		go m.pingLoop()
+	}
+	return m, nil
+}
+
+// awaitSettings drains frames until the peer's initial SETTINGS frame
+// arrives, acking it once found; any frame type is tolerated before that
+// since a real HTTP/2 peer may interleave other housekeeping frames.
+func awaitSettings(framer *http2.Framer) error {
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			return err
+		}
+		if sf, ok := f.(*http2.SettingsFrame); ok && !sf.IsAck() {
+			return framer.WriteSettingsAck()
+		}
+	}
+}
+
+func (m *H2Muxer) readLoop() {
+	for {
+		f, err := m.framer.ReadFrame()
+		if err != nil {
+			m.Close()
+			return
+		}
+		switch frame := f.(type) {
+		case *http2.DataFrame:
+			m.dispatchData(frame)
+		case *http2.WindowUpdateFrame:
+			m.dispatchWindowUpdate(frame)
+		case *http2.RSTStreamFrame:
+			m.closeStream(frame.StreamID)
+		case *http2.PingFrame:
+			m.handlePing(frame)
+		case *http2.SettingsFrame:
+			if !frame.IsAck() {
+				m.framer.WriteSettingsAck()
+			}
+		case *http2.GoAwayFrame:
+			m.Close()
+			return
+		}
+	}
+}
+
+func (m *H2Muxer) dispatchData(frame *http2.DataFrame) {
+	m.mu.Lock()
+	s, ok := m.streams[frame.StreamID]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	payload := make([]byte, len(frame.Data()))
+	copy(payload, frame.Data())
+	s.deliver(payload)
+	m.replenishConnWindow(len(payload))
+	s.replenishWindow(len(payload))
+	if frame.StreamEnded() {
+		m.closeStream(frame.StreamID)
+	}
+}
+
+// replenishConnWindow is readLoop's counterpart to h2Stream.replenishWindow
+// at the connection level: it accumulates bytes delivered across every
+// stream and, once that reaches half the configured window, sends a
+// stream-0 WINDOW_UPDATE so the peer's connSendWindow (see Write) keeps
+// getting refilled. Only readLoop ever calls this, so recvWindow itself
+// needs no lock.
+func (m *H2Muxer) replenishConnWindow(n int) {
+	if n == 0 {
+		return
+	}
+	m.recvWindow += int32(n)
+	threshold := m.cfg.WindowSize / 2
+	if threshold <= 0 || m.recvWindow < threshold {
+		return
+	}
+	increment := m.recvWindow
+	m.recvWindow = 0
+	m.writeMu.Lock()
+	m.framer.WriteWindowUpdate(0, uint32(increment))
+	m.writeMu.Unlock()
+}
+
+func (m *H2Muxer) dispatchWindowUpdate(frame *http2.WindowUpdateFrame) {
+	if frame.StreamID == 0 {
+		atomic.AddInt32(&m.connSendWindow, int32(frame.Increment))
+		select {
+		case m.connWindowSignal <- struct{}{}:
+		default:
+		}
+		return
+	}
+	m.mu.Lock()
+	s, ok := m.streams[frame.StreamID]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	atomic.AddInt32(&s.sendWindow, int32(frame.Increment))
+	select {
+	case s.windowSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (m *H2Muxer) handlePing(frame *http2.PingFrame) {
+	if frame.IsAck() {
+		if sentAt, ok := m.pingInFlight.Load(frame.Data); ok {
+			atomic.StoreInt64(&m.rtt, int64(time.Since(sentAt.(time.Time))))
+			m.pingInFlight.Delete(frame.Data)
+		}
+		select {
+		case m.pingAcked <- struct{}{}:
+		default:
+		}
+		return
+	}
+	m.writeMu.Lock()
+	m.framer.WritePing(true, frame.Data)
+	m.writeMu.Unlock()
+}
+
+func (m *H2Muxer) pingLoop() {
+	ticker := time.NewTicker(m.cfg.PingInterval)
+	defer ticker.Stop()
+	lastAck := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			if m.cfg.PingTimeout > 0 && time.Since(lastAck) > m.cfg.PingTimeout {
+				m.Close()
+				return
+			}
+			var data [8]byte
+			now := time.Now()
+			binaryPutNanos(data[:], now.UnixNano())
+			m.pingInFlight.Store(data, now)
+			m.writeMu.Lock()
+			m.framer.WritePing(false, data)
+			m.writeMu.Unlock()
+		case <-m.pingAcked:
+			lastAck = time.Now()
+		case <-m.closeCh:
+			return
+		}
+	}
+}
+
+// RTT returns the most recently measured PING round-trip time.
+func (m *H2Muxer) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.rtt))
+}
+
+func (m *H2Muxer) closeStream(id uint32) {
+	m.mu.Lock()
+	s, ok := m.streams[id]
+	if ok {
+		delete(m.streams, id)
+	}
+	m.mu.Unlock()
+	if ok {
+		s.markClosed()
+	}
+}
+
+// OpenStream allocates a new client-initiated stream ID, sends a HEADERS
+// frame carrying name as the ":path" pseudo-header (the same role the
+// tunnel name plays in Lunnel's smux.OpenStream), and returns a stream
+// ready for reading and writing.
+func (m *H2Muxer) OpenStream(name string) (io.ReadWriteCloser, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, errors.New("h2mux: muxer closed")
+	}
+	id := m.nextStreamID
+	m.nextStreamID += 2
+	s := &h2Stream{
+		id:           id,
+		mux:          m,
+		in:           make(chan []byte, 16),
+		closed:       make(chan struct{}),
+		sendWindow:   m.cfg.WindowSize,
+		windowSignal: make(chan struct{}, 1),
+	}
+	m.streams[id] = s
+	m.mu.Unlock()
+
+	m.hpackBuf.Reset()
+	m.hpackEnc.WriteField(hpack.HeaderField{Name: ":path", Value: name})
+	m.hpackEnc.WriteField(hpack.HeaderField{Name: ":method", Value: "CONNECT"})
+
+	m.writeMu.Lock()
+	err := m.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      id,
+		BlockFragment: m.hpackBuf.Bytes(),
+		EndHeaders:    true,
+	})
+	m.writeMu.Unlock()
+	if err != nil {
+		m.closeStream(id)
+		return nil, errors.Wrap(err, "h2mux: write HEADERS")
+	}
+	return s, nil
+}
+
+// NumStreams reports how many streams are currently open on this pipe, the
+// same signal smux.Session.NumStreams gives pipeManage for saturation
+// tracking.
+func (m *H2Muxer) NumStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+func (m *H2Muxer) IsClosed() bool {
+	select {
+	case <-m.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *H2Muxer) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.closeCh)
+	streams := m.streams
+	m.streams = make(map[uint32]*h2Stream)
+	m.mu.Unlock()
+	for _, s := range streams {
+		s.markClosed()
+	}
+	return m.conn.Close()
+}
+
+func binaryPutNanos(b []byte, nanos int64) {
+	for i := 0; i < 8; i++ {
+		b[i] = byte(nanos >> (56 - 8*i))
+	}
+}
+
+// h2Stream is one HTTP/2 stream, presented to callers as an
+// io.ReadWriteCloser the way a *smux.Stream already is.
+type h2Stream struct {
+	id  uint32
+	mux *H2Muxer
+
+	in     chan []byte
+	rbuf   bytes.Buffer
+	closed chan struct{}
+
+	sendWindow   int32
+	windowSignal chan struct{}
+
+	// recvWindow accumulates bytes delivered to this stream since the last
+	// stream-level WINDOW_UPDATE we sent back to the peer. dispatchData is
+	// its only writer (readLoop runs single-threaded), so it needs no lock.
+	recvWindow int32
+}
+
+func (s *h2Stream) deliver(payload []byte) {
+	select {
+	case s.in <- payload:
+	case <-s.closed:
+	}
+}
+
+// replenishWindow is the receive-side half of the stream's flow control:
+// without it, sendWindow (decremented by every Write on the peer) would
+// monotonically fall to zero and the peer's Write would block forever once
+// it had sent cfg.WindowSize bytes, regardless of how much we'd actually
+// consumed.
+func (s *h2Stream) replenishWindow(n int) {
+	if n == 0 {
+		return
+	}
+	s.recvWindow += int32(n)
+	threshold := s.mux.cfg.WindowSize / 2
+	if threshold <= 0 || s.recvWindow < threshold {
+		return
+	}
+	increment := s.recvWindow
+	s.recvWindow = 0
+	s.mux.writeMu.Lock()
+	s.mux.framer.WriteWindowUpdate(s.id, uint32(increment))
+	s.mux.writeMu.Unlock()
+}
+
+func (s *h2Stream) markClosed() {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	if s.rbuf.Len() > 0 {
+		return s.rbuf.Read(p)
+	}
+	select {
+	case payload := <-s.in:
+		s.rbuf.Write(payload)
+		return s.rbuf.Read(p)
+	case <-s.closed:
+		return 0, io.EOF
+	}
+}
+
+// Write splits p into DATA frames no larger than the stream's current
+// flow-control window or the connection's, blocking for WINDOW_UPDATE
+// frames when either is exhausted instead of overrunning the peer's
+// advertised capacity.
+func (s *h2Stream) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		for atomic.LoadInt32(&s.sendWindow) <= 0 || atomic.LoadInt32(&s.mux.connSendWindow) <= 0 {
+			select {
+			case <-s.windowSignal:
+			case <-s.mux.connWindowSignal:
+			case <-s.closed:
+				return total, errors.New("h2mux: stream closed")
+			}
+		}
+		n := len(p)
+		if w := int(atomic.LoadInt32(&s.sendWindow)); n > w {
+			n = w
+		}
+		if w := int(atomic.LoadInt32(&s.mux.connSendWindow)); n > w {
+			n = w
+		}
+		s.mux.writeMu.Lock()
+		err := s.mux.framer.WriteData(s.id, false, p[:n])
+		s.mux.writeMu.Unlock()
+		if err != nil {
+			return total, errors.Wrap(err, "h2mux: write DATA")
+		}
+		atomic.AddInt32(&s.sendWindow, -int32(n))
+		atomic.AddInt32(&s.mux.connSendWindow, -int32(n))
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (s *h2Stream) Close() error {
+	s.markClosed()
+	s.mux.writeMu.Lock()
+	err := s.mux.framer.WriteRSTStream(s.id, http2.ErrCodeNo)
+	s.mux.writeMu.Unlock()
+	s.mux.closeStream(s.id)
+	return err
+}
@@ -0,0 +1,178 @@
+package pipe
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"Lunnel/smux"
+)
+
+// fakeH2Peer stands in for the accepting side of an H2Muxer pipe
+// connection - normally the tunnel client, which lives outside this repo.
+// It echoes every DATA frame straight back on the same stream, after an
+// artificial delay for whichever stream ID is named slow, modeling the
+// retransmit-style latency a lossy link would add to one stream without
+// touching the others.
+type fakeH2Peer struct {
+	framer  *http2.Framer
+	writeMu sync.Mutex
+
+	slowID    uint32
+	slowDelay time.Duration
+}
+
+func newFakeH2Peer(conn net.Conn, slowID uint32, slowDelay time.Duration) (*fakeH2Peer, error) {
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		return nil, err
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		return nil, err
+	}
+	if err := awaitSettings(framer); err != nil {
+		return nil, err
+	}
+	return &fakeH2Peer{framer: framer, slowID: slowID, slowDelay: slowDelay}, nil
+}
+
+// run echoes DATA frames until the connection closes; it's meant to run in
+// its own goroutine for the lifetime of one benchmark iteration.
+func (p *fakeH2Peer) run() {
+	for {
+		f, err := p.framer.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch frame := f.(type) {
+		case *http2.DataFrame:
+			id := frame.StreamID
+			payload := append([]byte(nil), frame.Data()...)
+			echo := func() {
+				p.writeMu.Lock()
+				p.framer.WriteData(id, false, payload)
+				p.writeMu.Unlock()
+			}
+			if id == p.slowID && p.slowDelay > 0 {
+				// delay only this stream's echo; the read loop keeps
+				// serving every other stream meanwhile
+				go func() {
+					time.Sleep(p.slowDelay)
+					echo()
+				}()
+			} else {
+				echo()
+			}
+		case *http2.SettingsFrame:
+			if !frame.IsAck() {
+				p.writeMu.Lock()
+				p.framer.WriteSettingsAck()
+				p.writeMu.Unlock()
+			}
+		default:
+			// HEADERS just announces a new stream ID (tracked implicitly by
+			// echoing per-frame StreamID); WINDOW_UPDATE/RST/PING aren't
+			// needed for this benchmark's echo loop.
+		}
+	}
+}
+
+// benchmarkHeadOfLineBlocking opens numStreams streams over a muxer built by
+// open, writes payload on each, and waits for every stream's echo to come
+// back. One stream is deliberately slow to echo, the way a lossy link would
+// stall retransmission for just that stream; the benchmark's ns/op is how
+// long the whole batch took; i.e. whether the fast streams had to wait
+// behind the slow one.
+func benchmarkHeadOfLineBlocking(b *testing.B, open func() (Muxer, error), numStreams int, payload []byte) {
+	for i := 0; i < b.N; i++ {
+		mux, err := open()
+		if err != nil {
+			b.Fatalf("open: %v", err)
+		}
+		var wg sync.WaitGroup
+		for s := 0; s < numStreams; s++ {
+			stream, err := mux.OpenStream("bench")
+			if err != nil {
+				b.Fatalf("OpenStream: %v", err)
+			}
+			wg.Add(1)
+			go func(stream io.ReadWriteCloser) {
+				defer wg.Done()
+				buf := make([]byte, len(payload))
+				io.ReadFull(stream, buf)
+			}(stream)
+			if _, err := stream.Write(payload); err != nil {
+				b.Fatalf("Write: %v", err)
+			}
+		}
+		wg.Wait()
+		mux.Close()
+	}
+}
+
+func BenchmarkH2MuxHeadOfLineBlocking(b *testing.B) {
+	payload := make([]byte, 4096)
+	benchmarkHeadOfLineBlocking(b, func() (Muxer, error) {
+		clientConn, serverConn := net.Pipe()
+		peerReady := make(chan error, 1)
+		go func() {
+			// stream 1 is the first client-initiated stream ID (IDs then
+			// increment by 2), so it's the one we slow down.
+			peer, err := newFakeH2Peer(serverConn, 1, 20*time.Millisecond)
+			peerReady <- err
+			if err == nil {
+				peer.run()
+			}
+		}()
+		m, err := NewH2Muxer(clientConn, H2MuxerConfig{WindowSize: 64 * 1024})
+		if err != nil {
+			return nil, err
+		}
+		if err := <-peerReady; err != nil {
+			return nil, err
+		}
+		return m, nil
+	}, 4, payload)
+}
+
+func BenchmarkSmuxHeadOfLineBlocking(b *testing.B) {
+	payload := make([]byte, 4096)
+	benchmarkHeadOfLineBlocking(b, func() (Muxer, error) {
+		clientConn, serverConn := net.Pipe()
+		cfg := smux.DefaultConfig()
+		var accepted uint32
+		go func() {
+			sess, err := smux.Server(serverConn, cfg)
+			if err != nil {
+				return
+			}
+			for i := 0; i < 4; i++ {
+				stream, err := sess.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func(stream *smux.Stream, first bool) {
+					buf := make([]byte, len(payload))
+					if first {
+						time.Sleep(20 * time.Millisecond)
+					}
+					if _, err := io.ReadFull(stream, buf); err != nil {
+						return
+					}
+					stream.Write(buf)
+				}(stream, atomic.AddUint32(&accepted, 1) == 1)
+			}
+		}()
+		sess, err := smux.Client(clientConn, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return WrapSmux(sess), nil
+	}, 4, payload)
+}
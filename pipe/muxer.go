@@ -0,0 +1,18 @@
+// Package pipe abstracts over the stream multiplexer a pipe connection
+// runs, so Control can hold either a smux session or an HTTP/2-framed
+// session behind the same interface, selected per-control by
+// ControlClientHello.MuxMode.
+package pipe
+
+import "io"
+
+// Muxer is satisfied by every multiplexer implementation a pipe can use.
+// OpenStream's name argument is the tunnel the new stream proxies traffic
+// for, mirroring Lunnel's smux fork which already threads a tunnel name
+// through OpenStream for routing on the receiving end.
+type Muxer interface {
+	OpenStream(name string) (io.ReadWriteCloser, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+}
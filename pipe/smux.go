@@ -0,0 +1,26 @@
+package pipe
+
+import (
+	"io"
+
+	"Lunnel/smux"
+)
+
+// smuxMuxer adapts *smux.Session to Muxer. It exists only because Go
+// requires OpenStream's return type to match the interface exactly;
+// NumStreams, IsClosed and Close are promoted straight from the embedded
+// session.
+type smuxMuxer struct {
+	*smux.Session
+}
+
+// WrapSmux adapts an already-established smux session to Muxer, for the
+// "smux" MuxMode (the default, and the only mode before h2 support was
+// added).
+func WrapSmux(sess *smux.Session) Muxer {
+	return smuxMuxer{sess}
+}
+
+func (s smuxMuxer) OpenStream(name string) (io.ReadWriteCloser, error) {
+	return s.Session.OpenStream(name)
+}
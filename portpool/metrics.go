@@ -0,0 +1,20 @@
+package portpool
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// RegisterMetrics exposes pool's utilization as a Prometheus gauge under
+// the given label (typically "tcp" or "udp", matching the proto argument
+// tunnels are acquired with), so operators can alert before a pool fills
+// up and starts refusing new tunnels.
+func RegisterMetrics(pool *Pool, proto string) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   "lunnel",
+			Subsystem:   "portpool",
+			Name:        "utilization",
+			Help:        "Fraction of the configured port range currently in use or held for sticky reassignment.",
+			ConstLabels: prometheus.Labels{"proto": proto},
+		},
+		pool.Utilization,
+	))
+}
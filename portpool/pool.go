@@ -0,0 +1,227 @@
+// Package portpool replaces OS-assigned ("listen on :0") ports with a
+// server-managed range, so a reconnecting client can get the same external
+// port back instead of every client/tunnel moving to a new one each time.
+package portpool
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Strategy selects how Pool.Acquire picks a port when a client/tunnel pair
+// has no sticky reservation to reuse.
+type Strategy string
+
+const (
+	StrategySequential       Strategy = "sequential"
+	StrategyRandom           Strategy = "random"
+	StrategyStickyThenRandom Strategy = "sticky-then-random"
+)
+
+// ErrExhausted is returned by Acquire when every port in range is either
+// in use or held pending sticky reassignment.
+var ErrExhausted = errors.New("portpool: range exhausted")
+
+// Pool hands out ports from [min, max], remembering which (clientID,
+// tunnelName) pair last held each one so a reconnecting client can get it
+// back via Acquire, and persisting that mapping to Store so restarts don't
+// lose stickiness.
+type Pool struct {
+	min, max  uint16
+	strategy  Strategy
+	stickyTTL time.Duration
+	store     Store
+
+	mu       sync.Mutex
+	free     []uint16
+	unissued uint16 // next port never yet handed out, for sequential/lazy init
+	inUse    map[uint16]string
+	keyPort  map[string]uint16
+	portKey  map[uint16]string
+	pending  map[uint16]time.Time
+
+	stopCh chan struct{}
+}
+
+// New creates a Pool over [min, max]. store may be nil, in which case
+// sticky reservations don't survive a restart.
+func New(min, max uint16, strategy Strategy, stickyTTL time.Duration, store Store) (*Pool, error) {
+	if max < min {
+		return nil, errors.Errorf("portpool: invalid range [%d,%d]", min, max)
+	}
+	p := &Pool{
+		min:       min,
+		max:       max,
+		strategy:  strategy,
+		stickyTTL: stickyTTL,
+		store:     store,
+		unissued:  min,
+		inUse:     make(map[uint16]string),
+		keyPort:   make(map[string]uint16),
+		portKey:   make(map[uint16]string),
+		pending:   make(map[uint16]time.Time),
+		stopCh:    make(chan struct{}),
+	}
+	if store != nil {
+		saved, err := store.Load()
+		if err != nil {
+			return nil, errors.Wrap(err, "portpool: load store")
+		}
+		for key, port := range saved {
+			p.keyPort[key] = port
+			p.portKey[port] = key
+			p.pending[port] = time.Now()
+		}
+	}
+	if stickyTTL > 0 {
+		go p.janitor()
+	}
+	return p, nil
+}
+
+func key(proto, clientID, tunnelName string) string {
+	return proto + "|" + clientID + "|" + tunnelName
+}
+
+// Acquire returns the port to use for (proto, clientID, tunnelName): the
+// pair's previous port if one is still reserved (sticky reassignment), or
+// a freshly picked one from the free range otherwise.
+func (p *Pool) Acquire(proto, clientID, tunnelName string) (uint16, error) {
+	k := key(proto, clientID, tunnelName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if port, ok := p.keyPort[k]; ok {
+		delete(p.pending, port)
+		p.inUse[port] = k
+		return port, nil
+	}
+
+	port, ok := p.takeFree()
+	if !ok {
+		return 0, ErrExhausted
+	}
+	p.inUse[port] = k
+	p.keyPort[k] = port
+	p.portKey[port] = k
+	p.persist()
+	return port, nil
+}
+
+// takeFree picks an unreserved port according to p.strategy. Callers must
+// hold p.mu.
+func (p *Pool) takeFree() (uint16, bool) {
+	if len(p.free) > 0 {
+		var idx int
+		if p.strategy == StrategyRandom || p.strategy == StrategyStickyThenRandom {
+			idx = rand.Intn(len(p.free))
+		} else {
+			idx = len(p.free) - 1
+		}
+		port := p.free[idx]
+		p.free[idx] = p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		return port, true
+	}
+	// p.unissued only ever advances past ports that aren't already spoken
+	// for: a restart's Store.Load() populates p.portKey (in use and pending
+	// alike) without ever pushing those ports onto p.free, so skipping this
+	// check would let a brand-new reservation collide with a restored
+	// sticky one still waiting to be reclaimed.
+	for p.unissued <= p.max {
+		port := p.unissued
+		p.unissued++
+		if _, reserved := p.portKey[port]; reserved {
+			continue
+		}
+		return port, true
+	}
+	return 0, false
+}
+
+// Release gives back the port held by (proto, clientID, tunnelName).
+// Unless PortStickyTTL is zero, the port isn't returned to the free list
+// immediately: it's held pending in case the same client/tunnel
+// reconnects within the TTL window and calls Acquire again.
+func (p *Pool) Release(proto, clientID, tunnelName string) {
+	k := key(proto, clientID, tunnelName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	port, ok := p.keyPort[k]
+	if !ok {
+		return
+	}
+	delete(p.inUse, port)
+	if p.stickyTTL <= 0 {
+		delete(p.keyPort, k)
+		delete(p.portKey, port)
+		p.free = append(p.free, port)
+		p.persist()
+		return
+	}
+	p.pending[port] = time.Now()
+}
+
+func (p *Pool) janitor() {
+	ticker := time.NewTicker(p.stickyTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.reapExpired()
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *Pool) reapExpired() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for port, releasedAt := range p.pending {
+		if now.Sub(releasedAt) < p.stickyTTL {
+			continue
+		}
+		delete(p.pending, port)
+		if k, ok := p.portKey[port]; ok {
+			delete(p.keyPort, k)
+			delete(p.portKey, port)
+		}
+		p.free = append(p.free, port)
+	}
+	p.persist()
+}
+
+// persist writes the current key->port mapping to the configured store.
+// Callers must hold p.mu.
+func (p *Pool) persist() {
+	if p.store == nil {
+		return
+	}
+	snapshot := make(map[string]uint16, len(p.keyPort))
+	for k, port := range p.keyPort {
+		snapshot[k] = port
+	}
+	// best-effort: a failed save only costs stickiness across a crash, not
+	// correctness of the in-memory pool.
+	_ = p.store.Save(snapshot)
+}
+
+// Utilization returns the fraction of the range currently held (in use or
+// pending sticky reassignment), for the Prometheus gauge in metrics.go.
+func (p *Pool) Utilization() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	total := int(p.max-p.min) + 1
+	held := len(p.inUse) + len(p.pending)
+	return float64(held) / float64(total)
+}
+
+// Stop halts the sticky-reap janitor goroutine.
+func (p *Pool) Stop() {
+	close(p.stopCh)
+}
@@ -0,0 +1,54 @@
+package portpool
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Store persists the (clientID, tunnelName) -> port mapping across
+// restarts, so sticky reassignment survives the server process itself
+// being recycled, not just a single client's reconnect.
+type Store interface {
+	Load() (map[string]uint16, error)
+	Save(map[string]uint16) error
+}
+
+// FileStore is a Store backed by a single JSON file. It trades the
+// transactional guarantees a BoltDB-backed Store would give for zero extra
+// runtime dependency; servers that need stronger durability can provide
+// their own Store implementation.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a Store that persists to path, creating it on first
+// Save if it doesn't already exist.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (f *FileStore) Load() (map[string]uint16, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return map[string]uint16{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "portpool: read store file")
+	}
+	var m map[string]uint16
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "portpool: unmarshal store file")
+	}
+	return m, nil
+}
+
+func (f *FileStore) Save(m map[string]uint16) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "portpool: marshal store file")
+	}
+	return errors.Wrap(ioutil.WriteFile(f.path, data, 0600), "portpool: write store file")
+}
@@ -0,0 +1,154 @@
+// Package resume implements Cloak-style session-resumption tickets: an
+// AEAD-sealed blob a client can present on reconnect so the server can
+// reattach it to its prior session instead of renegotiating from scratch.
+package resume
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Ticket is the payload sealed inside a ResumptionTicket. ID is generated
+// fresh by Seal and is what the server's quarantine map is keyed by;
+// TunnelConfigs is caller-opaque (the server json-marshals its
+// []msg.TunnelConfig into it) and is carried along only so a resumed
+// ControlServerHello can echo back what the client already knows.
+type Ticket struct {
+	ID              string
+	ClientID        string
+	PreMasterSecret []byte
+	TunnelConfigs   []byte
+	IssuedAt        time.Time
+}
+
+// Expired reports whether t is older than maxAge, i.e. TicketTimeHint.
+func (t Ticket) Expired(maxAge time.Duration) bool {
+	return time.Since(t.IssuedAt) > maxAge
+}
+
+// KeyRotator seals and opens Tickets under an AES-GCM key that rotates on
+// a timer, so a leaked key only ever exposes tickets issued during its
+// window. Open tries both the current and immediately preceding key, so a
+// ticket issued just before a rotation still resumes.
+type KeyRotator struct {
+	mu       sync.RWMutex
+	current  cipher.AEAD
+	previous cipher.AEAD
+
+	stopCh chan struct{}
+}
+
+// NewKeyRotator starts a KeyRotator whose key is replaced every
+// rotateEvery.
+func NewKeyRotator(rotateEvery time.Duration) (*KeyRotator, error) {
+	aead, err := newRandomAEAD()
+	if err != nil {
+		return nil, err
+	}
+	kr := &KeyRotator{current: aead, stopCh: make(chan struct{})}
+	go kr.loop(rotateEvery)
+	return kr, nil
+}
+
+func newRandomAEAD() (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "resume: generate key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "resume: aes.NewCipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+func (kr *KeyRotator) loop(rotateEvery time.Duration) {
+	ticker := time.NewTicker(rotateEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			aead, err := newRandomAEAD()
+			if err != nil {
+				continue
+			}
+			kr.mu.Lock()
+			kr.previous = kr.current
+			kr.current = aead
+			kr.mu.Unlock()
+		case <-kr.stopCh:
+			return
+		}
+	}
+}
+
+// Stop halts the key-rotation timer.
+func (kr *KeyRotator) Stop() {
+	close(kr.stopCh)
+}
+
+// Seal assigns t a fresh ID and IssuedAt, then returns that ID alongside
+// the sealed blob to hand back to the client as ControlServerHello.Ticket.
+// The caller keeps the ID to key its own quarantine map; Open independently
+// recovers the same ID from the blob so a client's wire-level reconnect
+// doesn't need to send it separately.
+func (kr *KeyRotator) Seal(t Ticket) (id string, blob []byte, err error) {
+	rawID := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, rawID); err != nil {
+		return "", nil, errors.Wrap(err, "resume: generate ticket id")
+	}
+	t.ID = fmt.Sprintf("%x", rawID)
+	t.IssuedAt = time.Now()
+
+	plaintext, err := json.Marshal(t)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "resume: marshal ticket")
+	}
+	kr.mu.RLock()
+	aead := kr.current
+	kr.mu.RUnlock()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, errors.Wrap(err, "resume: generate nonce")
+	}
+	return t.ID, aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts blob, trying the current key and then the previous one.
+func (kr *KeyRotator) Open(blob []byte) (Ticket, error) {
+	kr.mu.RLock()
+	aeads := make([]cipher.AEAD, 0, 2)
+	aeads = append(aeads, kr.current)
+	if kr.previous != nil {
+		aeads = append(aeads, kr.previous)
+	}
+	kr.mu.RUnlock()
+
+	var lastErr error
+	for _, aead := range aeads {
+		if len(blob) < aead.NonceSize() {
+			lastErr = errors.New("resume: ticket too short")
+			continue
+		}
+		nonce, ciphertext := blob[:aead.NonceSize()], blob[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var t Ticket
+		if err := json.Unmarshal(plaintext, &t); err != nil {
+			return Ticket{}, errors.Wrap(err, "resume: unmarshal ticket")
+		}
+		return t, nil
+	}
+	return Ticket{}, errors.Wrap(lastErr, "resume: ticket did not decrypt under any known key")
+}
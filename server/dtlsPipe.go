@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"Lunnel/dtlspipe"
+	"Lunnel/msg"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pion/dtls/v2"
+	"github.com/pkg/errors"
+)
+
+// dtlsPipe is a Control's counterpart to its smux idle/busy pipe lists, for
+// tunnels opened with msg.TunnelConfig.Transport == "dtls". Unlike smux
+// pipes, a UDP tunnel has exactly one DTLS association per tunnel name,
+// since datagrams have no independent-stream concept to multiplex.
+type dtlsPipe struct {
+	mu    sync.RWMutex
+	conns map[string]*dtls.Conn
+}
+
+func newDTLSPipe() *dtlsPipe {
+	return &dtlsPipe{conns: make(map[string]*dtls.Conn)}
+}
+
+// putDatagram installs the DTLS association used to carry tunnelName's
+// datagrams, replacing whatever association previously held that slot.
+func (d *dtlsPipe) putDatagram(tunnelName string, conn *dtls.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.conns[tunnelName]; ok {
+		old.Close()
+	}
+	d.conns[tunnelName] = conn
+}
+
+// getDatagram returns the DTLS association carrying tunnelName's datagrams,
+// if one has completed its handshake yet.
+func (d *dtlsPipe) getDatagram(tunnelName string) (*dtls.Conn, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	conn, ok := d.conns[tunnelName]
+	return conn, ok
+}
+
+// dtlsPipeListener demultiplexes the single shared UDP flock every client's
+// DTLS-transport tunnels ride on, the same way the smux pipe listener
+// demultiplexes pipe connections by reading a PipeClientHello off each new
+// TCP/KCP connection before handing it to PipeHandShake.
+var dtlsPipeListener *dtlspipe.Listener
+
+// ListenDTLSPipe binds the shared UDP flock dtlsPipeHandShake accepts
+// associations from. It should be called once at startup, alongside the
+// control and smux-pipe listeners.
+func ListenDTLSPipe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return errors.Wrap(err, "binding dtls pipe flock")
+	}
+	dtlsPipeListener = dtlspipe.NewListener(pc)
+	go func() {
+		for {
+			assoc, err := dtlsPipeListener.Accept()
+			if err != nil {
+				return
+			}
+			go dtlsPipeHandShake(assoc)
+		}
+	}()
+	return nil
+}
+
+// dtlsPipeHandShake first reads the client's DTLSPipeClientHello, sent in
+// the clear as the association's first message, to learn which Control and
+// tunnel this association carries datagrams for; it then runs the PSK-mode
+// DTLS server handshake with the PSK derived for that Control and tunnel.
+func dtlsPipeHandShake(assoc net.Conn) {
+	mType, body, err := msg.ReadMsg(assoc)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warningln("dtls pipe: read DTLSPipeClientHello")
+		assoc.Close()
+		return
+	}
+	if mType != msg.TypeDTLSPipeClientHello {
+		assoc.Close()
+		return
+	}
+	dphs := body.(*msg.DTLSPipeClientHello)
+
+	ControlMapLock.RLock()
+	ctl := ControlMap[dphs.ClientID]
+	ControlMapLock.RUnlock()
+	if ctl == nil {
+		assoc.Close()
+		return
+	}
+
+	conn, err := dtlspipe.Server(assoc, dtlspipe.Config{
+		PreMasterSecret: ctl.preMasterSecret,
+		ClientID:        ctl.ClientID[:],
+		TunnelName:      dphs.TunnelName,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "tunnel": dphs.TunnelName}).Warningln("dtls handshake failed")
+		assoc.Close()
+		return
+	}
+	ctl.dtlsPipe.putDatagram(dphs.TunnelName, conn)
+}
+
+// relayDatagrams shuttles UDP payloads between the public-facing listener
+// pc and tunnelName's DTLS association, preserving datagram boundaries the
+// way the smux-backed path (proxyConn, over a reliable byte stream) cannot.
+// It tracks only the most recently seen remote address per tunnel: a
+// DTLS-transport tunnel is meant for a single active peer (e.g. a media or
+// gaming session), not a fan-in of unrelated UDP clients.
+func relayDatagrams(pc net.PacketConn, c *Control, tunnelName string) {
+	var lastRemote net.Addr
+	var remoteMu sync.Mutex
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, remote, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			remoteMu.Lock()
+			lastRemote = remote
+			remoteMu.Unlock()
+			conn, ok := c.dtlsPipe.getDatagram(tunnelName)
+			if !ok {
+				// no DTLS association has registered for this tunnel yet
+				continue
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				log.WithFields(log.Fields{"err": err, "tunnel": tunnelName}).Warningln("dtls write failed")
+			}
+		}
+	}()
+
+	for {
+		if c.IsClosed() {
+			return
+		}
+		conn, ok := c.dtlsPipe.getDatagram(tunnelName)
+		if !ok {
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		buf := make([]byte, 64*1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			// A dead/replaced DTLS association keeps returning the same
+			// error on every call; without a pause this spins the CPU
+			// until the next association registers.
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		remoteMu.Lock()
+		remote := lastRemote
+		remoteMu.Unlock()
+		if remote == nil {
+			continue
+		}
+		if _, err := pc.WriteTo(buf[:n], remote); err != nil {
+			log.WithFields(log.Fields{"err": err, "tunnel": tunnelName}).Warningln("write to public client failed")
+		}
+	}
+}
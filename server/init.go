@@ -0,0 +1,110 @@
+package main
+
+import (
+	"Lunnel/auth"
+	"Lunnel/portpool"
+	"Lunnel/resume"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// InitServer constructs every optional subsystem serverConf enables before
+// the control listener starts accepting connections. Each one stays
+// nil/disabled when its serverConf flag is off, same as before; this just
+// makes sure the enabled ones are actually built instead of staying nil
+// forever. main calls this once, at startup.
+func InitServer() error {
+	if err := initAuth(); err != nil {
+		return errors.Wrap(err, "initAuth")
+	}
+	if err := initPortPools(); err != nil {
+		return errors.Wrap(err, "initPortPools")
+	}
+	if err := initDTLSPipeListener(); err != nil {
+		return errors.Wrap(err, "initDTLSPipeListener")
+	}
+	if err := initResume(); err != nil {
+		return errors.Wrap(err, "initResume")
+	}
+	return nil
+}
+
+// initAuth builds Authenticator from serverConf.AuthSpec when auth is
+// enabled, so ServerHandShake's Authenticator.Validate call has a real
+// backend instead of a nil interface.
+func initAuth() error {
+	if !serverConf.AuthEnable {
+		return nil
+	}
+	a, err := auth.NewAuth(serverConf.AuthSpec)
+	if err != nil {
+		return errors.Wrap(err, "auth.NewAuth")
+	}
+	Authenticator = a
+	log.WithFields(log.Fields{"spec": serverConf.AuthSpec}).Infoln("auth backend initialized")
+	return nil
+}
+
+// initPortPools builds TCPPortPool/UDPPortPool from serverConf's configured
+// ranges when they're non-zero, so tcpListenAddr/udpListenAddr actually draw
+// sticky ports instead of always falling back to ":0". Each pool gets its
+// own FileStore file: FileStore.Save does a full overwrite, so one shared
+// file would have whichever pool persists last clobber the other's sticky
+// state, and Load would hand each pool the other protocol's reservations
+// back on restart.
+func initPortPools() error {
+	if serverConf.TcpPortRangeMax > 0 {
+		var store portpool.Store
+		if serverConf.PortPoolStateFile != "" {
+			store = portpool.NewFileStore(serverConf.PortPoolStateFile + ".tcp")
+		}
+		pool, err := portpool.New(serverConf.TcpPortRangeMin, serverConf.TcpPortRangeMax, portpool.StrategyStickyThenRandom, serverConf.PortStickyTTL, store)
+		if err != nil {
+			return errors.Wrap(err, "portpool.New tcp")
+		}
+		TCPPortPool = pool
+		portpool.RegisterMetrics(TCPPortPool, "tcp")
+	}
+	if serverConf.UdpPortRangeMax > 0 {
+		var store portpool.Store
+		if serverConf.PortPoolStateFile != "" {
+			store = portpool.NewFileStore(serverConf.PortPoolStateFile + ".udp")
+		}
+		pool, err := portpool.New(serverConf.UdpPortRangeMin, serverConf.UdpPortRangeMax, portpool.StrategyStickyThenRandom, serverConf.PortStickyTTL, store)
+		if err != nil {
+			return errors.Wrap(err, "portpool.New udp")
+		}
+		UDPPortPool = pool
+		portpool.RegisterMetrics(UDPPortPool, "udp")
+	}
+	return nil
+}
+
+// initDTLSPipeListener binds the shared DTLS pipe flock when
+// serverConf.DTLSPipeEnable is set, so dtls-transport tunnels have an
+// association listener to register with.
+func initDTLSPipeListener() error {
+	if !serverConf.DTLSPipeEnable {
+		return nil
+	}
+	if err := ListenDTLSPipe(serverConf.DTLSPipeListenAddr); err != nil {
+		return errors.Wrap(err, "ListenDTLSPipe")
+	}
+	return nil
+}
+
+// initResume builds resumeTickets when serverConf.ResumeEnable is set, so
+// ServerHandShake actually issues resumption tickets and moderator
+// quarantines a disconnected Control instead of always tearing it down.
+func initResume() error {
+	if !serverConf.ResumeEnable {
+		return nil
+	}
+	kr, err := resume.NewKeyRotator(serverConf.ResumeKeyRotateEvery)
+	if err != nil {
+		return errors.Wrap(err, "resume.NewKeyRotator")
+	}
+	resumeTickets = kr
+	return nil
+}
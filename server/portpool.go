@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"Lunnel/portpool"
+
+	"github.com/pkg/errors"
+)
+
+// TCPPortPool and UDPPortPool are the server-managed port allocators set up
+// from serverConf.TcpPortRangeMin/Max (and the Udp equivalents) at startup.
+// They are nil when port pooling isn't configured, in which case
+// ServerAddTunnels falls back to letting the OS assign a port via ":0".
+var TCPPortPool *portpool.Pool
+var UDPPortPool *portpool.Pool
+
+// tcpListenAddr returns the listen address ServerAddTunnels should bind for
+// a tcp tunnel: a pool-assigned port when TCPPortPool is configured, or
+// ":0" to let the OS pick one otherwise.
+func tcpListenAddr(clientID, tunnelName string) (string, error) {
+	return poolListenAddr(TCPPortPool, "tcp", clientID, tunnelName)
+}
+
+// udpListenAddr is tcpListenAddr's udp-pool counterpart, used by both the
+// smux-relayed and dtls-relayed udp tunnel paths.
+func udpListenAddr(clientID, tunnelName string) (string, error) {
+	return poolListenAddr(UDPPortPool, "udp", clientID, tunnelName)
+}
+
+func poolListenAddr(pool *portpool.Pool, proto, clientID, tunnelName string) (string, error) {
+	if pool == nil {
+		return fmt.Sprintf("%s:0", serverConf.ListenIP), nil
+	}
+	port, err := pool.Acquire(proto, clientID, tunnelName)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s port pool exhausted", proto)
+	}
+	return fmt.Sprintf("%s:%d", serverConf.ListenIP, port), nil
+}
+
+// releaseTunnelPort returns t's externally-bound port to the pool it came
+// from, mirroring the Acquire call ServerAddTunnels made when the tunnel
+// was created. It's a no-op for http/https tunnels, which never draw from
+// a port pool.
+func releaseTunnelPort(clientID string, t *Tunnel) {
+	switch t.tunnelConfig.Protocol {
+	case "tcp":
+		releaseTCPPort(clientID, t.tunnelName)
+	case "udp":
+		releaseUDPPort(clientID, t.tunnelName)
+	}
+}
+
+// releaseTCPPort and releaseUDPPort give back an acquired port without a
+// *Tunnel to hand releaseTunnelPort, for ServerAddTunnels to call when
+// net.Listen/net.ListenPacket fails after a successful Acquire - otherwise
+// that port would never return to the pool.
+func releaseTCPPort(clientID, tunnelName string) {
+	if TCPPortPool != nil {
+		TCPPortPool.Release("tcp", clientID, tunnelName)
+	}
+}
+
+func releaseUDPPort(clientID, tunnelName string) {
+	if UDPPortPool != nil {
+		UDPPortPool.Release("udp", clientID, tunnelName)
+	}
+}
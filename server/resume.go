@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"Lunnel/msg"
+	"Lunnel/resume"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// resumeTickets seals and opens ResumptionTickets for every control session
+// when serverConf.ResumeEnable is set. It's nil when resumption is
+// disabled, in which case ServerHandShake never issues tickets and
+// moderator never quarantines a Control instead of tearing it down.
+var resumeTickets *resume.KeyRotator
+
+var quarantineLock sync.Mutex
+
+// quarantine holds Controls moderator has parked instead of destroyed,
+// keyed by the ID of the ResumptionTicket that can reclaim them. It's the
+// resumable counterpart to ControlMap, which stays keyed by ClientID and is
+// never cleared on quarantine since a Control's existing pipes are still
+// valid TCP connections independent of its control channel.
+var quarantine = make(map[string]*quarantineEntry)
+
+// quarantineEntry pairs a quarantined Control with the timer that will
+// finalize its teardown once serverConf.ResumeGracePeriod elapses unresumed.
+type quarantineEntry struct {
+	ctl   *Control
+	timer *time.Timer
+	done  chan bool
+}
+
+// quarantineControl parks c in the quarantine map under its ticketID and
+// blocks until either reattachControl reclaims it (returns true) or
+// ResumeGracePeriod expires unresumed (returns false).
+func quarantineControl(c *Control) bool {
+	entry := &quarantineEntry{ctl: c, done: make(chan bool, 1)}
+	entry.timer = time.AfterFunc(serverConf.ResumeGracePeriod, func() {
+		quarantineLock.Lock()
+		if cur, ok := quarantine[c.ticketID]; ok && cur == entry {
+			delete(quarantine, c.ticketID)
+		}
+		quarantineLock.Unlock()
+		select {
+		case entry.done <- false:
+		default:
+		}
+	})
+
+	quarantineLock.Lock()
+	quarantine[c.ticketID] = entry
+	quarantineLock.Unlock()
+
+	log.WithFields(log.Fields{"ClientId": c.ClientID, "ticketID": c.ticketID}).Infoln("control quarantined, awaiting resume")
+	return <-entry.done
+}
+
+// tryResume attempts to resume a quarantined Control for a ticket presented
+// in a ControlClientHello. It returns a nil Control (with a nil error) when
+// the ticket is well-formed but stale or unknown, so the caller falls back
+// to a fresh handshake instead of failing the connection outright.
+func tryResume(ticketBlob []byte, conn net.Conn) (*Control, error) {
+	ticket, err := resumeTickets.Open(ticketBlob)
+	if err != nil {
+		return nil, errors.Wrap(err, "resume.KeyRotator.Open")
+	}
+	if ticket.Expired(serverConf.TicketTimeHint) {
+		log.WithFields(log.Fields{"ticketID": ticket.ID}).Warningln("resumption ticket expired")
+		return nil, nil
+	}
+	c := reattachControl(ticket, conn)
+	if c == nil {
+		log.WithFields(log.Fields{"ticketID": ticket.ID}).Warningln("resumption ticket has no matching quarantined control")
+		return nil, nil
+	}
+
+	var shello msg.ControlServerHello
+	shello.ClientID = c.ClientID
+	var tunnelConfigs []msg.TunnelConfig
+	if err := json.Unmarshal(ticket.TunnelConfigs, &tunnelConfigs); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warningln("failed to decode resumed tunnel configs")
+	} else {
+		shello.TunnelConfigs = tunnelConfigs
+	}
+	if err := issueTicket(c, &shello); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warningln("failed to issue resumption ticket")
+	}
+	if err := msg.WriteMsg(c.ctlConn, msg.TypeControlServerHello, shello); err != nil {
+		return nil, errors.Wrap(err, "Write ClientId")
+	}
+	return c, nil
+}
+
+// reattachControl looks up the quarantined Control for ticket.ID and, if
+// still parked there, reattaches it to conn: c.tunnels, their listeners,
+// their TunnelMap entries, and c's idle/busy pipe lists all carry over
+// untouched, so the caller never reruns AddMember or port allocation for
+// them. It signals the blocked quarantineControl call to return true,
+// which sends moderator back around its loop to watch the new session.
+func reattachControl(ticket resume.Ticket, conn net.Conn) *Control {
+	quarantineLock.Lock()
+	entry, ok := quarantine[ticket.ID]
+	if ok {
+		delete(quarantine, ticket.ID)
+	}
+	quarantineLock.Unlock()
+	if !ok {
+		return nil
+	}
+	entry.timer.Stop()
+
+	c := entry.ctl
+	c.ctlConn = conn
+	c.preMasterSecret = ticket.PreMasterSecret
+	c.sessionDone = make(chan struct{})
+	c.startSession()
+
+	ControlMapLock.Lock()
+	ControlMap[c.ClientID] = c
+	ControlMapLock.Unlock()
+
+	select {
+	case entry.done <- true:
+	default:
+	}
+	return c
+}
+
+// issueTicket seals a ResumptionTicket for c's current session into
+// shello.Ticket and records its ID on c so moderator knows to quarantine
+// rather than tear down on the next disconnect.
+func issueTicket(c *Control, shello *msg.ControlServerHello) error {
+	tunnelConfigs := make([]msg.TunnelConfig, 0, len(c.tunnels))
+	for _, t := range c.tunnels {
+		tunnelConfigs = append(tunnelConfigs, t.tunnelConfig)
+	}
+	encodedConfigs, err := json.Marshal(tunnelConfigs)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal tunnelConfigs")
+	}
+
+	id, blob, err := resumeTickets.Seal(resume.Ticket{
+		ClientID:        c.ClientID.String(),
+		PreMasterSecret: c.preMasterSecret,
+		TunnelConfigs:   encodedConfigs,
+	})
+	if err != nil {
+		return errors.Wrap(err, "resume.KeyRotator.Seal")
+	}
+	c.ticketID = id
+	shello.Ticket = blob
+	return nil
+}
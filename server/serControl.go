@@ -1,13 +1,18 @@
 package main
 
 import (
+	"Lunnel/auth"
 	"Lunnel/contrib"
 	"Lunnel/crypto"
 	"Lunnel/msg"
+	"Lunnel/obfs"
+	"Lunnel/pipe"
 	"Lunnel/smux"
 	"Lunnel/util"
+	"container/heap"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -17,8 +22,19 @@ import (
 	"github.com/pkg/errors"
 )
 
-var maxIdlePipes int = 3
-var maxStreams int = 6
+// Authenticator is the configured pluggable auth backend, set up from
+// serverConf.AuthSpec at startup. It is nil when serverConf.AuthEnable is
+// false.
+var Authenticator auth.Auth
+
+// Defaults for the pipe-pool knobs NewControl seeds onto every Control;
+// serverConf can override them per client before calling Serve.
+const (
+	defaultMaxIdlePipes        = 3
+	defaultMaxStreams          = 6
+	defaultPipeSaturationRatio = 0.75
+	defaultPipeSampleK         = 3
+)
 
 var pingInterval time.Duration = time.Second * 8
 var pingTimeout time.Duration = time.Second * 17
@@ -34,13 +50,20 @@ var TunnelMap = make(map[string]*Tunnel)
 
 func NewControl(conn net.Conn, encryptMode string) *Control {
 	ctl := &Control{
-		ctlConn:     conn,
-		pipeGet:     make(chan *smux.Session),
-		pipeAdd:     make(chan *smux.Session),
-		die:         make(chan struct{}),
-		toDie:       make(chan struct{}),
-		writeChan:   make(chan writeReq, 128),
-		encryptMode: encryptMode,
+		ctlConn:             conn,
+		pipeGet:             make(chan pipe.Muxer),
+		pipeAdd:             make(chan pipe.Muxer),
+		die:                 make(chan struct{}),
+		toDie:               make(chan struct{}),
+		sessionDone:         make(chan struct{}),
+		writeChan:           make(chan writeReq, 128),
+		encryptMode:         encryptMode,
+		dtlsPipe:            newDTLSPipe(),
+		maxIdlePipes:        defaultMaxIdlePipes,
+		maxStreams:          defaultMaxStreams,
+		pipeSaturationRatio: defaultPipeSaturationRatio,
+		pipeSampleK:         defaultPipeSampleK,
+		pipeStats:           make(map[pipe.Muxer]*pipeStats),
 	}
 	return ctl
 }
@@ -53,14 +76,91 @@ type writeReq struct {
 type Tunnel struct {
 	tunnelConfig msg.TunnelConfig
 	listener     net.Listener
-	tunnelName   string
-	ctl          *Control
+	// packetConn is the bound UDP socket backing a dtls-transport tunnel's
+	// relayDatagrams goroutines. listener is nil for these tunnels since a
+	// net.PacketConn isn't a net.Listener; teardown closes whichever of the
+	// two is set.
+	packetConn net.PacketConn
+	tunnelName string
+	ctl        *Control
 }
 
 type pipeNode struct {
 	prev *pipeNode
 	next *pipeNode
-	pipe *smux.Session
+	pipe pipe.Muxer
+}
+
+// pipeStats tracks an EWMA of stream-open latency for one pipe, so
+// selectIdlePipe can deprioritize a pipe whose RTT has spiked even if its
+// stream count still looks light. It outlives any single idle/busy
+// transition, keyed by pipe identity in Control.pipeStats.
+type pipeStats struct {
+	mu       sync.Mutex
+	openEWMA float64 // seconds
+}
+
+// pipeStatsEWMAAlpha weights the newest stream-open sample against the
+// running average; higher reacts faster to RTT spikes, lower smooths them
+// out more.
+const pipeStatsEWMAAlpha = 0.2
+
+func (s *pipeStats) recordOpen(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sample := d.Seconds()
+	if s.openEWMA == 0 {
+		s.openEWMA = sample
+		return
+	}
+	s.openEWMA = pipeStatsEWMAAlpha*sample + (1-pipeStatsEWMAAlpha)*s.openEWMA
+}
+
+func (s *pipeStats) ewma() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.openEWMA
+}
+
+// pipeEntry is the idle-pool element container/heap orders idleHeap by.
+type pipeEntry struct {
+	pipe          pipe.Muxer
+	lastUsedNanos int64
+	index         int
+}
+
+// idleHeap is a min-heap over idle pipes keyed by (NumStreams ascending,
+// then most-recently-used first), so getPipe's best-of-k sample is drawn
+// from the least-loaded, warmest pipes instead of whichever one happens to
+// sit at the head of a linked list.
+type idleHeap []*pipeEntry
+
+func (h idleHeap) Len() int { return len(h) }
+func (h idleHeap) Less(i, j int) bool {
+	si, sj := h[i].pipe.NumStreams(), h[j].pipe.NumStreams()
+	if si != sj {
+		return si < sj
+	}
+	return h[i].lastUsedNanos > h[j].lastUsedNanos
+}
+func (h idleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *idleHeap) Push(x interface{}) {
+	e := x.(*pipeEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *idleHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
 }
 
 type Control struct {
@@ -70,32 +170,56 @@ type Control struct {
 	lastRead        uint64
 	encryptMode     string
 
-	busyPipes *pipeNode
-	idleCount int
-	idlePipes *pipeNode
-	pipeAdd   chan *smux.Session
-	pipeGet   chan *smux.Session
+	muxMode string
+
+	// maxIdlePipes, maxStreams, pipeSaturationRatio and pipeSampleK were
+	// package-level vars; they're per-Control so serverConf can tune them
+	// per client and tests can drive them deterministically.
+	maxIdlePipes        int
+	maxStreams          int
+	pipeSaturationRatio float64
+	pipeSampleK         int
 
-	die       chan struct{}
-	toDie     chan struct{}
-	writeChan chan writeReq
+	busyPipes *pipeNode
+	idleHeap  idleHeap
+	// statsLock guards pipeStats: unlike the rest of the pool, which only
+	// pipeManage's single goroutine ever touches, recordStreamOpen is
+	// called from every proxyConn goroutine.
+	statsLock sync.Mutex
+	pipeStats map[pipe.Muxer]*pipeStats
+	pipeAdd   chan pipe.Muxer
+	pipeGet   chan pipe.Muxer
+
+	dtlsPipe *dtlsPipe
+
+	// quota is the limit Authenticator.(auth.QuotaProvider) attached to
+	// this Control's token, if the configured backend implements it. It's
+	// the zero Quota (unlimited) when auth is disabled or the backend
+	// doesn't track quotas.
+	quota auth.Quota
+
+	// ticketID is the ID of the ResumptionTicket last issued for this
+	// Control, i.e. the key it's quarantined under if the connection
+	// drops. Empty when resumption isn't enabled for this session.
+	ticketID string
+
+	die   chan struct{} // closed once, on final (non-resumable) teardown
+	toDie chan struct{}
+	// sessionDone is closed when the current ctlConn's session ends,
+	// whether or not it goes on to be resumed; it's recreated by resume
+	// for the new session. die, by contrast, is closed exactly once.
+	sessionDone chan struct{}
+	writeChan   chan writeReq
 
 	ClientID crypto.UUID
 }
 
-func (c *Control) addIdlePipe(pipe *smux.Session) {
-	pNode := &pipeNode{pipe: pipe, prev: nil, next: nil}
-	if c.idlePipes != nil {
-		c.idlePipes.prev = pNode
-		pNode.next = c.idlePipes
-	}
-	c.idlePipes = pNode
-	c.idleCount++
-
+func (c *Control) addIdlePipe(p pipe.Muxer) {
+	heap.Push(&c.idleHeap, &pipeEntry{pipe: p, lastUsedNanos: time.Now().UnixNano()})
 }
 
-func (c *Control) addBusyPipe(pipe *smux.Session) {
-	pNode := &pipeNode{pipe: pipe, prev: nil, next: nil}
+func (c *Control) addBusyPipe(p pipe.Muxer) {
+	pNode := &pipeNode{pipe: p, prev: nil, next: nil}
 	if c.busyPipes != nil {
 		c.busyPipes.prev = pNode
 		pNode.next = c.busyPipes
@@ -103,19 +227,85 @@ func (c *Control) addBusyPipe(pipe *smux.Session) {
 	c.busyPipes = pNode
 }
 
-func (c *Control) removeIdleNode(pNode *pipeNode) {
-	if pNode.prev == nil {
-		c.idlePipes = pNode.next
-		if c.idlePipes != nil {
-			c.idlePipes.prev = nil
+// statsFor returns p's persistent latency stats, creating them on first
+// use so they survive every idle/busy transition until forgetStats removes
+// them on final close.
+func (c *Control) statsFor(p pipe.Muxer) *pipeStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	s, ok := c.pipeStats[p]
+	if !ok {
+		s = &pipeStats{}
+		c.pipeStats[p] = s
+	}
+	return s
+}
+
+func (c *Control) forgetStats(p pipe.Muxer) {
+	c.statsLock.Lock()
+	delete(c.pipeStats, p)
+	c.statsLock.Unlock()
+}
+
+// recordStreamOpen feeds d into p's stream-open-latency EWMA; proxyConn
+// calls this right after OpenStream so a pipe whose RTT is spiking gets
+// deprioritized the next time it's sampled by selectIdlePipe.
+func (c *Control) recordStreamOpen(p pipe.Muxer, d time.Duration) {
+	c.statsFor(p).recordOpen(d)
+}
+
+// selectIdlePipe samples up to c.pipeSampleK non-closed idle pipes and
+// returns the one with the fewest active streams (ties broken by lower
+// stream-open EWMA latency), pruning any closed pipes it encounters along
+// the way. The bool return reports whether the winner's own load already
+// reaches pipeSaturationRatio*maxStreams, so the caller knows to also
+// request a fresh pipe via msg.TypePipeReq instead of just handing this
+// one out.
+func (c *Control) selectIdlePipe() (pipe.Muxer, bool) {
+	for {
+		n := len(c.idleHeap)
+		if n == 0 {
+			return nil, false
+		}
+		k := c.pipeSampleK
+		if k > n {
+			k = n
+		}
+		sample := make([]*pipeEntry, 0, k)
+		for _, idx := range rand.Perm(n)[:k] {
+			sample = append(sample, c.idleHeap[idx])
+		}
+
+		var winner *pipeEntry
+		var winnerEWMA float64
+		prunedClosed := false
+		for _, e := range sample {
+			if e.pipe.IsClosed() {
+				heap.Remove(&c.idleHeap, e.index)
+				c.forgetStats(e.pipe)
+				prunedClosed = true
+				continue
+			}
+			ewma := c.statsFor(e.pipe).ewma()
+			if winner == nil {
+				winner, winnerEWMA = e, ewma
+				continue
+			}
+			winnerStreams, eStreams := winner.pipe.NumStreams(), e.pipe.NumStreams()
+			if eStreams < winnerStreams || (eStreams == winnerStreams && ewma < winnerEWMA) {
+				winner, winnerEWMA = e, ewma
+			}
 		}
-	} else {
-		pNode.prev.next = pNode.next
-		if pNode.next != nil {
-			pNode.next.prev = pNode.prev
+		if winner == nil {
+			if prunedClosed {
+				continue
+			}
+			return nil, false
 		}
+		heap.Remove(&c.idleHeap, winner.index)
+		saturated := winner.pipe.NumStreams() >= int(float64(c.maxStreams)*c.pipeSaturationRatio)
+		return winner.pipe, saturated
 	}
-	c.idleCount--
 }
 
 func (c *Control) removeBusyNode(pNode *pipeNode) {
@@ -132,7 +322,7 @@ func (c *Control) removeBusyNode(pNode *pipeNode) {
 	}
 }
 
-func (c *Control) putPipe(p *smux.Session) {
+func (c *Control) putPipe(p pipe.Muxer) {
 	select {
 	case c.pipeAdd <- p:
 	case <-c.die:
@@ -142,7 +332,7 @@ func (c *Control) putPipe(p *smux.Session) {
 	return
 }
 
-func (c *Control) getPipe() *smux.Session {
+func (c *Control) getPipe() pipe.Muxer {
 	select {
 	case p := <-c.pipeGet:
 		return p
@@ -151,6 +341,10 @@ func (c *Control) getPipe() *smux.Session {
 	}
 }
 
+// clean demotes busy pipes that have drained below maxStreams back to the
+// idle pool (or drops them if closed), then trims the idle heap: since a
+// min-heap's root is always its global minimum, an idle, zero-stream pipe
+// sitting over maxIdlePipes is guaranteed to be at c.idleHeap[0].
 func (c *Control) clean() {
 	busy := c.busyPipes
 	for {
@@ -159,90 +353,74 @@ func (c *Control) clean() {
 		}
 		if busy.pipe.IsClosed() {
 			c.removeBusyNode(busy)
-		} else if busy.pipe.NumStreams() < maxStreams {
+			c.forgetStats(busy.pipe)
+		} else if busy.pipe.NumStreams() < c.maxStreams {
 			c.removeBusyNode(busy)
 			c.addIdlePipe(busy.pipe)
 		}
 		busy = busy.next
 	}
-	idle := c.idlePipes
-	for {
-		if idle == nil {
-			return
-		}
-		if idle.pipe.IsClosed() {
-			c.removeIdleNode(idle)
-		} else if idle.pipe.NumStreams() == 0 && c.idleCount > maxIdlePipes {
-			log.WithFields(log.Fields{"time": time.Now().Unix(), "pipe": fmt.Sprintf("%p", idle.pipe)}).Infoln("remove and close idle")
-			c.removeIdleNode(idle)
-			idle.pipe.Close()
-		}
-		idle = idle.next
+	for len(c.idleHeap) > 0 {
+		top := c.idleHeap[0]
+		if top.pipe.IsClosed() {
+			heap.Remove(&c.idleHeap, top.index)
+			c.forgetStats(top.pipe)
+			continue
+		}
+		if top.pipe.NumStreams() == 0 && len(c.idleHeap) > c.maxIdlePipes {
+			log.WithFields(log.Fields{"time": time.Now().Unix(), "pipe": fmt.Sprintf("%p", top.pipe)}).Infoln("remove and close idle")
+			heap.Remove(&c.idleHeap, top.index)
+			top.pipe.Close()
+			c.forgetStats(top.pipe)
+			continue
+		}
+		break
 	}
-	return
-
-}
-func (c *Control) getIdleFast() (idle *pipeNode) {
-	idle = c.idlePipes
-	for {
-		if idle == nil {
-			return
-		}
-		if idle.pipe.IsClosed() {
-			c.removeIdleNode(idle)
-			idle = idle.next
-		} else {
-			c.removeIdleNode(idle)
-			return
-		}
-	}
-	return
 }
 
 func (c *Control) pipeManage() {
-	var available *smux.Session
+	var available pipe.Muxer
 	ticker := time.NewTicker(cleanInterval)
 	defer ticker.Stop()
 	for {
 	Prepare:
 		if available == nil || available.IsClosed() {
 			available = nil
-			idle := c.getIdleFast()
+			idle, saturated := c.selectIdlePipe()
 			if idle == nil {
 				c.clean()
-				idle := c.getIdleFast()
+				idle, saturated = c.selectIdlePipe()
+			}
+			if idle == nil || saturated {
 				c.writeChan <- writeReq{msg.TypePipeReq, nil}
-				if idle == nil {
-					pipeGetTimeout := time.After(time.Second * 12)
-					for {
-						select {
-						case <-ticker.C:
-							c.clean()
-							idle := c.getIdleFast()
-							if idle != nil {
-								available = idle.pipe
+			}
+			if idle == nil {
+				pipeGetTimeout := time.After(time.Second * 12)
+				for {
+					select {
+					case <-ticker.C:
+						c.clean()
+						if idle, _ := c.selectIdlePipe(); idle != nil {
+							available = idle
+							goto Available
+						}
+					case p := <-c.pipeAdd:
+						if !p.IsClosed() {
+							if p.NumStreams() < c.maxStreams {
+								available = p
 								goto Available
+							} else {
+								c.addBusyPipe(p)
 							}
-						case p := <-c.pipeAdd:
-							if !p.IsClosed() {
-								if p.NumStreams() < maxStreams {
-									available = p
-									goto Available
-								} else {
-									c.addBusyPipe(p)
-								}
-							}
-						case <-c.die:
-							return
-						case <-pipeGetTimeout:
-							goto Prepare
 						}
+					case <-c.die:
+						return
+					case <-pipeGetTimeout:
+						goto Prepare
 					}
-				} else {
-					available = idle.pipe
 				}
 			} else {
-				available = idle.pipe
+				available = idle
 			}
 		}
 	Available:
@@ -254,7 +432,7 @@ func (c *Control) pipeManage() {
 			available = nil
 		case p := <-c.pipeAdd:
 			if !p.IsClosed() {
-				if p.NumStreams() < maxStreams {
+				if p.NumStreams() < c.maxStreams {
 					c.addIdlePipe(p)
 				} else {
 					c.addBusyPipe(p)
@@ -284,17 +462,50 @@ func (c *Control) IsClosed() bool {
 	}
 }
 
+// moderator waits for the current session to report trouble via toDie. If
+// this Control was issued a resumption ticket, it's quarantined instead of
+// torn down immediately: tunnels, listeners and pipes are left alone, and
+// moderator blocks on quarantineControl until either a client presents the
+// matching ticket (reattachControl closes over the same Control and signals
+// resumed=true, so moderator loops back to wait on the new session) or
+// ResumeGracePeriod elapses, at which point it falls through to teardown.
 func (c *Control) moderator() {
-	_ = <-c.toDie
-	log.WithFields(log.Fields{"ClientId": c.ClientID}).Infoln("client going to close")
+	for {
+		<-c.toDie
+		log.WithFields(log.Fields{"ClientId": c.ClientID}).Infoln("control connection lost")
+		close(c.sessionDone)
+		c.ctlConn.Close()
+
+		if resumeTickets == nil || c.ticketID == "" {
+			c.teardown()
+			return
+		}
+		if !quarantineControl(c) {
+			c.teardown()
+			return
+		}
+		log.WithFields(log.Fields{"ClientId": c.ClientID}).Infoln("control resumed from quarantine")
+	}
+}
+
+// teardown is the final, unresumable cleanup: it closes tunnel listeners,
+// removes their TunnelMap entries, releases pool ports, notifies
+// contrib.RemoveMember, and closes every pipe. It's only ever run once per
+// Control, either because resumption isn't in play or because a
+// quarantined Control's grace period expired unresumed.
+func (c *Control) teardown() {
 	close(c.die)
 	for _, t := range c.tunnels {
 		if t.listener != nil {
 			t.listener.Close()
 		}
+		if t.packetConn != nil {
+			t.packetConn.Close()
+		}
 		TunnelMapLock.Lock()
 		delete(TunnelMap, t.tunnelConfig.RemoteAddr())
 		TunnelMapLock.Unlock()
+		releaseTunnelPort(c.ClientID.String(), t)
 		if serverConf.NotifyEnable {
 			err := contrib.RemoveMember(serverConf.ServerDomain, t.tunnelConfig.RemoteAddr())
 			if err != nil {
@@ -302,15 +513,10 @@ func (c *Control) moderator() {
 			}
 		}
 	}
-	idle := c.idlePipes
-	for {
-		if idle == nil {
-			break
-		}
+	for _, idle := range c.idleHeap {
 		if !idle.pipe.IsClosed() {
 			idle.pipe.Close()
 		}
-		idle = idle.next
 	}
 	busy := c.busyPipes
 	for {
@@ -326,11 +532,17 @@ func (c *Control) moderator() {
 }
 
 func (c *Control) recvLoop() {
+	sessionDone := c.sessionDone
 	atomic.StoreUint64(&c.lastRead, uint64(time.Now().UnixNano()))
 	for {
 		if c.IsClosed() {
 			return
 		}
+		select {
+		case <-sessionDone:
+			return
+		default:
+		}
 		mType, body, err := msg.ReadMsgWithoutTimeout(c.ctlConn)
 		if err != nil {
 			log.WithFields(log.Fields{"err": err}).Warningln("ReadMsgWithoutTimeout failed")
@@ -350,6 +562,7 @@ func (c *Control) recvLoop() {
 }
 
 func (c *Control) writeLoop() {
+	sessionDone := c.sessionDone
 	lastWrite := time.Now()
 	idx := 0
 	for {
@@ -375,17 +588,33 @@ func (c *Control) writeLoop() {
 			}
 		case <-c.die:
 			return
+		case <-sessionDone:
+			return
 		}
 	}
 
 }
 
+// Serve starts a freshly handshaken Control: the long-lived moderator and
+// pipeManage goroutines, which persist across a resume, plus the current
+// session's recvLoop/writeLoop/pingLoop.
 func (c *Control) Serve() {
 	go c.moderator()
+	go c.pipeManage()
+	c.startSession()
+}
+
+// startSession launches the goroutines bound to the current c.ctlConn. It's
+// called once by Serve for a fresh handshake, and again by reattachControl
+// after a client resumes a quarantined Control over a new ctlConn.
+func (c *Control) startSession() {
 	go c.recvLoop()
 	go c.writeLoop()
-	go c.pipeManage()
+	go c.pingLoop()
+}
 
+func (c *Control) pingLoop() {
+	sessionDone := c.sessionDone
 	ticker := time.NewTicker(pingInterval)
 	defer ticker.Stop()
 
@@ -400,9 +629,13 @@ func (c *Control) Serve() {
 			case c.writeChan <- writeReq{msg.TypePing, nil}:
 			case <-c.die:
 				return
+			case <-sessionDone:
+				return
 			}
 		case <-c.die:
 			return
+		case <-sessionDone:
+			return
 		}
 	}
 }
@@ -413,7 +646,9 @@ func proxyConn(userConn net.Conn, c *Control, tunnelName string) {
 	if p == nil {
 		return
 	}
+	openStart := time.Now()
 	stream, err := p.OpenStream(tunnelName)
+	c.recordStreamOpen(p, time.Since(openStart))
 	if err != nil {
 		c.putPipe(p)
 		return
@@ -439,19 +674,62 @@ func proxyConn(userConn net.Conn, c *Control, tunnelName string) {
 
 func (c *Control) ServerAddTunnels(sstm *msg.AddTunnels) error {
 	for name, _ := range sstm.Tunnels {
+		if c.quota.MaxTunnels > 0 && len(c.tunnels)+1 > c.quota.MaxTunnels {
+			msg.WriteMsg(c.ctlConn, msg.TypeError, msg.Error{Message: "tunnel quota exceeded"})
+			return errors.Errorf("ClientId(%s) exceeded tunnel quota(%d)", c.ClientID, c.quota.MaxTunnels)
+		}
 		tunnelConfig := sstm.Tunnels[name]
 		tunnelConfig.Hostname = serverConf.ServerDomain
 		var lis net.Listener = nil
 
 		if tunnelConfig.Protocol == "tcp" || tunnelConfig.Protocol == "udp" {
 			if tunnelConfig.Protocol == "tcp" {
-				lis, err = net.Listen("tcp", fmt.Sprintf("%s:0", serverConf.ListenIP))
+				listenAddr, acquireErr := tcpListenAddr(c.ClientID.String(), name)
+				if acquireErr != nil {
+					msg.WriteMsg(c.ctlConn, msg.TypeError, msg.Error{Message: acquireErr.Error()})
+					return errors.Wrap(acquireErr, "TCPPortPool.Acquire")
+				}
+				lis, err = net.Listen("tcp", listenAddr)
 				if err != nil {
+					releaseTCPPort(c.ClientID.String(), name)
 					return errors.Wrap(err, "binding TCP listener")
 				}
+			} else if tunnelConfig.Transport == "dtls" {
+				listenAddr, acquireErr := udpListenAddr(c.ClientID.String(), name)
+				if acquireErr != nil {
+					msg.WriteMsg(c.ctlConn, msg.TypeError, msg.Error{Message: acquireErr.Error()})
+					return errors.Wrap(acquireErr, "UDPPortPool.Acquire")
+				}
+				var pc net.PacketConn
+				pc, err = net.ListenPacket("udp", listenAddr)
+				if err != nil {
+					releaseUDPPort(c.ClientID.String(), name)
+					return errors.Wrap(err, "binding dtls udp listener")
+				}
+				go relayDatagrams(pc, c, name)
+				tunnelConfig.RemotePort = uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+				sstm.Tunnels[name] = tunnelConfig
+				if serverConf.NotifyEnable {
+					err = contrib.AddMember(serverConf.ServerDomain, tunnelConfig.RemoteAddr())
+					if err != nil {
+						log.WithFields(log.Fields{"err": err}).Errorln("notify add member failed!")
+					}
+				}
+				tunnel := Tunnel{tunnelConfig: tunnelConfig, packetConn: pc, ctl: c, tunnelName: name}
+				c.tunnels = append(c.tunnels, &tunnel)
+				TunnelMapLock.Lock()
+				TunnelMap[tunnel.tunnelConfig.RemoteAddr()] = &tunnel
+				TunnelMapLock.Unlock()
+				continue
 			} else {
-				lis, err = net.Listen("udp", fmt.Sprintf("%s:0", serverConf.ListenIP))
+				listenAddr, acquireErr := udpListenAddr(c.ClientID.String(), name)
+				if acquireErr != nil {
+					msg.WriteMsg(c.ctlConn, msg.TypeError, msg.Error{Message: acquireErr.Error()})
+					return errors.Wrap(acquireErr, "UDPPortPool.Acquire")
+				}
+				lis, err = net.Listen("udp", listenAddr)
 				if err != nil {
+					releaseUDPPort(c.ClientID.String(), name)
 					return errors.Wrap(err, "binding udp listener")
 				}
 			}
@@ -467,12 +745,17 @@ func (c *Control) ServerAddTunnels(sstm *msg.AddTunnels) error {
 					go proxyConn(conn, c, tunnelName)
 				}
 			}(name)
-			//todo: port allocated by server not by OS
 			addr := lis.Addr().(*net.TCPAddr)
 			tunnelConfig.RemotePort = uint16(addr.Port)
 		} else if tunnelConfig.Protocol == "http" || tunnelConfig.Protocol == "https" {
-			subDomain := util.Int2Short(atomic.AddUint64(&subDomainIdx, 1))
-			tunnelConfig.Subdomain = string(subDomain)
+			if tunnelConfig.Subdomain != "" && len(c.quota.AllowedSubdomain) > 0 && !stringInSlice(tunnelConfig.Subdomain, c.quota.AllowedSubdomain) {
+				msg.WriteMsg(c.ctlConn, msg.TypeError, msg.Error{Message: "subdomain not permitted by quota"})
+				return errors.Errorf("ClientId(%s) requested subdomain %q not permitted by quota", c.ClientID, tunnelConfig.Subdomain)
+			}
+			if tunnelConfig.Subdomain == "" {
+				subDomain := util.Int2Short(atomic.AddUint64(&subDomainIdx, 1))
+				tunnelConfig.Subdomain = string(subDomain)
+			}
 			if tunnelConfig.Protocol == "http" {
 				tunnelConfig.RemotePort = serverConf.HttpPort
 			} else {
@@ -500,83 +783,163 @@ func (c *Control) ServerAddTunnels(sstm *msg.AddTunnels) error {
 	return nil
 }
 
+// stringInSlice reports whether s is present in list, used to check a
+// client-requested subdomain against c.quota.AllowedSubdomain.
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Control) GenerateClientId() crypto.UUID {
 	c.ClientID = crypto.GenUUID()
 	return c.ClientID
 }
 
-func (c *Control) ServerHandShake() error {
+// ServerHandShake runs the control handshake for a freshly accepted conn
+// and returns the Control to Serve. It's a package-level function, rather
+// than a method, because a ticket-bearing reconnect doesn't produce a new
+// Control at all: it reattaches conn to the quarantined *Control from the
+// client's prior session, which ServerHandShake returns in place of the
+// freshly allocated one.
+func ServerHandShake(conn net.Conn, encryptMode string) (*Control, error) {
+	c := NewControl(conn, encryptMode)
 	var shello msg.ControlServerHello
 	var chello *msg.ControlClientHello
+	if c.encryptMode == "tls-mimic" {
+		deobfsConn, err := obfs.MakeDeobfs(c.ctlConn, []byte(serverConf.ObfsPresharedKey), serverConf.ObfsMTU)
+		if err != nil {
+			return nil, errors.Wrap(err, "obfs.MakeDeobfs")
+		}
+		c.ctlConn = deobfsConn
+	}
 	mType, body, err := msg.ReadMsg(c.ctlConn)
 	if err != nil {
-		return errors.Wrap(err, "msg.ReadMsg")
+		return nil, errors.Wrap(err, "msg.ReadMsg")
 	}
 	if mType != msg.TypeControlClientHello {
-		return errors.Errorf("invalid msg type(%d),expect(%d)", mType, msg.TypeControlClientHello)
+		return nil, errors.Errorf("invalid msg type(%d),expect(%d)", mType, msg.TypeControlClientHello)
 	}
 	chello = body.(*msg.ControlClientHello)
+
+	if resumeTickets != nil && len(chello.Ticket) > 0 {
+		resumed, err := tryResume(chello.Ticket, c.ctlConn)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Warningln("ticket resume failed, falling back to fresh handshake")
+		} else if resumed != nil {
+			return resumed, nil
+		}
+	}
+
+	c.muxMode = chello.MuxMode
+	if c.muxMode == "" {
+		c.muxMode = "smux"
+	}
 	if serverConf.AuthEnable {
-		isok, err := contrib.Auth(chello.AuthToken)
+		clientIP := c.ctlConn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(clientIP); err == nil {
+			clientIP = host
+		}
+		meta := auth.ClientMeta{ClientIP: clientIP}
+		isok, err := Authenticator.Validate(chello.AuthToken, meta)
 		if err != nil {
-			return errors.Wrap(err, "contrib.Auth")
+			return nil, errors.Wrap(err, "Authenticator.Validate")
 		}
 		if !isok {
-			return errors.Errorf("auth failed!token:%s", chello.AuthToken)
+			return nil, errors.Errorf("auth failed!token:%s", chello.AuthToken)
+		}
+		if qp, ok := Authenticator.(auth.QuotaProvider); ok {
+			c.quota = qp.QuotaFor(chello.AuthToken)
 		}
 	}
 
 	if c.encryptMode != "none" {
 		priv, keyMsg := crypto.GenerateKeyExChange()
 		if keyMsg == nil || priv == nil {
-			return errors.Errorf("crypto.GenerateKeyExChange error ,exchange key is nil")
+			return nil, errors.Errorf("crypto.GenerateKeyExChange error ,exchange key is nil")
 		}
 		preMasterSecret, err := crypto.ProcessKeyExchange(priv, chello.CipherKey)
 		if err != nil {
-			return errors.Wrap(err, "crypto.ProcessKeyExchange")
+			return nil, errors.Wrap(err, "crypto.ProcessKeyExchange")
 		}
 		c.preMasterSecret = preMasterSecret
 		shello.CipherKey = keyMsg
 	}
 	shello.ClientID = c.GenerateClientId()
+
+	if resumeTickets != nil {
+		if err := issueTicket(c, &shello); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warningln("failed to issue resumption ticket")
+		}
+	}
+
 	err = msg.WriteMsg(c.ctlConn, msg.TypeControlServerHello, shello)
 	if err != nil {
-		return errors.Wrap(err, "Write ClientId")
+		return nil, errors.Wrap(err, "Write ClientId")
 	}
 
 	ControlMapLock.Lock()
 	ControlMap[c.ClientID] = c
 	ControlMapLock.Unlock()
-	return nil
+	return c, nil
 }
 
 func PipeHandShake(conn net.Conn, phs *msg.PipeClientHello) error {
 	ControlMapLock.RLock()
 	ctl := ControlMap[phs.ClientID]
 	ControlMapLock.RUnlock()
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.MaxReceiveBuffer = 4194304
+
 	var err error
-	var sess *smux.Session
+	if ctl.encryptMode == "tls-mimic" {
+		conn, err = obfs.MakeDeobfs(conn, []byte(serverConf.ObfsPresharedKey), serverConf.ObfsMTU)
+		if err != nil {
+			return errors.Wrap(err, "obfs.MakeDeobfs")
+		}
+	}
 	if ctl.encryptMode != "none" {
 		prf := crypto.NewPrf12()
 		var masterKey []byte = make([]byte, 16)
 		prf(masterKey, ctl.preMasterSecret, phs.ClientID[:], phs.Once[:])
-		cryptoConn, err := crypto.NewCryptoConn(conn, masterKey)
+		conn, err = crypto.NewCryptoConn(conn, masterKey)
 		if err != nil {
 			return errors.Wrap(err, "crypto.NewCryptoConn")
 		}
-		//server endpoint is the pipe connection source,so we use smux.Client
-		sess, err = smux.Client(cryptoConn, smuxConfig)
+	}
+
+	mux, err := newPipeMuxer(ctl, conn)
+	if err != nil {
+		return err
+	}
+	ctl.putPipe(mux)
+	return nil
+}
+
+// newPipeMuxer builds the Muxer implementation selected by ctl.muxMode
+// ("smux", the default, or "h2") for a pipe connection that has already
+// been through obfuscation and encryption.
+func newPipeMuxer(ctl *Control, conn net.Conn) (pipe.Muxer, error) {
+	switch ctl.muxMode {
+	case "h2":
+		m, err := pipe.NewH2Muxer(conn, pipe.H2MuxerConfig{
+			WindowSize:   serverConf.H2WindowSize,
+			PingInterval: pingInterval,
+			PingTimeout:  pingTimeout,
+		})
 		if err != nil {
-			return errors.Wrap(err, "smux.Client")
+			return nil, errors.Wrap(err, "pipe.NewH2Muxer")
 		}
-	} else {
-		sess, err = smux.Client(conn, smuxConfig)
+		return m, nil
+	default:
+		smuxConfig := smux.DefaultConfig()
+		smuxConfig.MaxReceiveBuffer = 4194304
+		//server endpoint is the pipe connection source,so we use smux.Client
+		sess, err := smux.Client(conn, smuxConfig)
 		if err != nil {
-			return errors.Wrap(err, "smux.Client")
+			return nil, errors.Wrap(err, "smux.Client")
 		}
+		return pipe.WrapSmux(sess), nil
 	}
-	ctl.putPipe(sess)
-	return nil
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"Lunnel/pipe"
+)
+
+// fakeMuxer is a minimal pipe.Muxer test double whose NumStreams and
+// IsClosed are set directly, so pipe-pool tests can drive Control's
+// idle/busy transitions deterministically instead of needing a real smux
+// or h2mux session.
+type fakeMuxer struct {
+	numStreams int
+	closed     bool
+}
+
+func (f *fakeMuxer) OpenStream(name string) (io.ReadWriteCloser, error) { return nil, nil }
+func (f *fakeMuxer) NumStreams() int                                    { return f.numStreams }
+func (f *fakeMuxer) IsClosed() bool                                     { return f.closed }
+func (f *fakeMuxer) Close() error                                       { f.closed = true; return nil }
+
+// newTestControl builds a Control with small, deterministic pipe-pool knobs
+// - the whole reason maxIdlePipes/maxStreams/pipeSaturationRatio/pipeSampleK
+// moved from package vars onto Control in the first place.
+func newTestControl() *Control {
+	c := NewControl(nil, "none")
+	c.maxIdlePipes = 2
+	c.maxStreams = 4
+	c.pipeSaturationRatio = 0.5
+	c.pipeSampleK = 3
+	return c
+}
+
+func TestSelectIdlePipePrefersFewerStreams(t *testing.T) {
+	c := newTestControl()
+	busy := &fakeMuxer{numStreams: 3}
+	idle := &fakeMuxer{numStreams: 0}
+	c.addIdlePipe(busy)
+	c.addIdlePipe(idle)
+
+	got, saturated := c.selectIdlePipe()
+	if got != pipe.Muxer(idle) {
+		t.Fatalf("selectIdlePipe picked %v, want the less-loaded pipe", got)
+	}
+	if saturated {
+		t.Fatalf("selectIdlePipe reported saturated for an empty pipe")
+	}
+}
+
+func TestSelectIdlePipeReportsSaturation(t *testing.T) {
+	c := newTestControl()
+	// maxStreams=4, pipeSaturationRatio=0.5 -> saturated at >= 2 streams.
+	loaded := &fakeMuxer{numStreams: 2}
+	c.addIdlePipe(loaded)
+
+	_, saturated := c.selectIdlePipe()
+	if !saturated {
+		t.Fatalf("selectIdlePipe did not report saturation for a pipe at the ratio threshold")
+	}
+}
+
+func TestSelectIdlePipePrunesClosed(t *testing.T) {
+	c := newTestControl()
+	closed := &fakeMuxer{closed: true}
+	open := &fakeMuxer{numStreams: 0}
+	c.addIdlePipe(closed)
+	c.addIdlePipe(open)
+
+	got, _ := c.selectIdlePipe()
+	if got != pipe.Muxer(open) {
+		t.Fatalf("selectIdlePipe returned a closed pipe instead of pruning it")
+	}
+	if _, ok := c.pipeStats[closed]; ok {
+		t.Fatalf("forgetStats did not clean up the pruned pipe's stats")
+	}
+}
+
+func TestCleanTrimsIdleHeapPastMaxIdlePipes(t *testing.T) {
+	c := newTestControl() // maxIdlePipes = 2
+	for i := 0; i < 4; i++ {
+		c.addIdlePipe(&fakeMuxer{numStreams: 0})
+	}
+	c.clean()
+	if len(c.idleHeap) != c.maxIdlePipes {
+		t.Fatalf("clean left %d idle pipes, want %d", len(c.idleHeap), c.maxIdlePipes)
+	}
+}
+
+func TestCleanDemotesDrainedBusyPipe(t *testing.T) {
+	c := newTestControl() // maxStreams = 4
+	p := &fakeMuxer{numStreams: 1}
+	c.addBusyPipe(p)
+	c.clean()
+	if len(c.idleHeap) != 1 {
+		t.Fatalf("clean did not demote a busy pipe under maxStreams back to idle")
+	}
+}
@@ -62,6 +62,10 @@ func newCompStream(conn net.Conn) *compStream {
 }
 
 func main() {
+	if err := InitServer(); err != nil {
+		panic(err)
+	}
+
 	pass := pbkdf2.Key([]byte("asdnanan"), []byte(SALT), 4096, 32, sha1.New)
 	block, _ := kcp.NewNoneBlockCrypt(pass)
 	lis, err := kcp.ListenWithOptions("192.168.100.103:8888", block, dataShard, parityShard)